@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE favicons ADD COLUMN fetched_at DATETIME;
+ALTER TABLE favicons ADD COLUMN expires_at DATETIME;
+
+-- Existing rows keep the documented 24-hour lifetime from when they were cached
+UPDATE favicons
+SET fetched_at = created_at,
+    expires_at = datetime(created_at, '+1 day');
+
+CREATE INDEX idx_favicons_expires_at ON favicons(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_favicons_expires_at;
+ALTER TABLE favicons DROP COLUMN expires_at;
+ALTER TABLE favicons DROP COLUMN fetched_at;
+-- +goose StatementEnd
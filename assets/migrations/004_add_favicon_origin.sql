@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The origin the requested domain resolved to after following homepage redirects
+ALTER TABLE favicons ADD COLUMN origin TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE favicons DROP COLUMN origin;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Renditions derived from the cached favicon, e.g. rasterized SVGs
+CREATE TABLE favicon_variants (
+    domain TEXT NOT NULL,
+    format TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    data BLOB NOT NULL,
+    content_type TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (domain, format, size)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE favicon_variants;
+-- +goose StatementEnd
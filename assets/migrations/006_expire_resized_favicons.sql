@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Favicons used to be stored already resized to 16px. Mark them stale so they
+-- are refetched at full resolution and larger sizes can be derived from them.
+UPDATE favicons
+SET expires_at = datetime('now')
+WHERE expires_at > datetime('now');
+-- +goose StatementEnd
+
+-- +goose Down
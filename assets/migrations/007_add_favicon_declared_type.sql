@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The Content-Type the origin served the icon with, kept when it disagreed with
+-- the type sniffed from the icon's bytes
+ALTER TABLE favicons ADD COLUMN declared_content_type TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE favicons DROP COLUMN declared_content_type;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The ranking score of the candidate the favicon was chosen from, served in
+-- the X-Favicon-Score header; NULL for favicons cached before it was stored
+ALTER TABLE favicons ADD COLUMN score INTEGER;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE favicons DROP COLUMN score;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Hash of the favicon data, so ETags are known without reading the data;
+-- rows cached before it existed are filled in on startup
+ALTER TABLE favicons ADD COLUMN data_hash TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE favicons DROP COLUMN data_hash;
+-- +goose StatementEnd
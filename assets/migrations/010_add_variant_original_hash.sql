@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Hash of the original a rendition was derived from, so a rendition saved
+-- after a refresh replaced the original is never served for the new one
+ALTER TABLE favicon_variants ADD COLUMN original_hash TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE favicon_variants DROP COLUMN original_hash;
+-- +goose StatementEnd
@@ -3,30 +3,57 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"image"
+	"image/color"
+	_ "image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pressly/goose/v3"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
 	"github.com/wajeht/favicon/assets"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -41,19 +68,32 @@ const (
 	responseHeaderTimeout = 500 * time.Millisecond
 	expectContinueTimeout = 200 * time.Millisecond
 
-	faviconFetchTimeout = 1500 * time.Millisecond
-	maxHTMLReadSize     = 512 * 1024  // 512KB
-	maxImageSize        = 1024 * 1024 // 1MB
+	maxRedirects         = 5
+	faviconFetchTimeout  = 1500 * time.Millisecond
+	faviconRankingWindow = 250 * time.Millisecond
+	maxHTMLReadSize      = 512 * 1024  // 512KB
+	maxImageSize         = 1024 * 1024 // 1MB
+	maxImagePixels       = 2048 * 2048
+	sniffPrefixSize      = 1024
 
-	targetIconSize = 16
-	jpegQuality    = 90
+	targetIconSize   = 16
+	scalableIconSize = 256
+	jpegQuality      = 90
 
 	maxOpenConns    = 100
 	maxIdleDBConns  = 25
 	connMaxLifetime = 5 * time.Minute
 
-	cacheTTL     = 86400 // 1 day in seconds
-	listCacheTTL = 300   // 5 minutes in seconds
+	cacheTTL      = 86400 // 1 day in seconds
+	listCacheTTL  = 300   // 5 minutes in seconds
+	staleCacheTTL = 60    // 1 minute in seconds
+
+	staleRetryDelay = 15 * time.Minute
+
+	defaultFaviconTTL = 24 * time.Hour
+	defaultFailureTTL = 1 * time.Hour
+	maxFailureBackoff = 7 * 24 * time.Hour
+	sqliteTimeFormat  = "2006-01-02 15:04:05"
 
 	serverAddr      = ":80"
 	shutdownTimeout = 30 * time.Second
@@ -62,12 +102,61 @@ const (
 )
 
 var (
-	ErrNotFound = errors.New("favicon not found")
+	ErrNotFound  = errors.New("favicon not found")
+	ErrNoFavicon = errors.New("no favicon found")
+
+	ErrInvalidHost        = errors.New("invalid host")
+	ErrBlockedDestination = errors.New("destination address is not allowed")
+	ErrUnsafeSVG          = errors.New("unsafe SVG document")
+	ErrImageTooLarge      = errors.New("image exceeds size limits")
 
 	repo *FaviconRepository
 
+	faviconTTL = envDuration("FAVICON_TTL", defaultFaviconTTL)
+	failureTTL = envDuration("FAVICON_FAILURE_TTL", defaultFailureTTL)
+	allowHTTP  = envBool("FAVICON_ALLOW_HTTP", true)
+	resampler  = envResampler("FAVICON_RESAMPLER", "catmullrom")
+
+	fallbackHosts   = parseHostList(os.Getenv("FAVICON_FALLBACK_HOSTS"))
+	defaultFallback = envFallback("FAVICON_FALLBACK", "default")
+
+	refreshesInFlight   sync.Map
+	backgroundRefreshes sync.WaitGroup
+
+	discoveries      singleflight.Group
+	discoveryMetrics DiscoveryMetrics
+	renderMetrics    RenderMetrics
+
+	discoveryWaitersMu sync.Mutex
+	discoveryWaiting   = make(map[string]*discoveryWaiters)
+
+	// serverCtx is the parent of every request context and of background
+	// refreshes; it is cancelled on shutdown to stop discovery still running.
+	serverCtx, stopServer = context.WithCancel(context.Background())
+
+	outbound   = newOutboundPolicy(os.Getenv("FAVICON_ALLOWED_HOSTS"))
 	httpClient = newHTTPClient()
 
+	// outputFormats maps the values accepted by the format query parameter
+	// to the content type they produce.
+	outputFormats = map[string]string{
+		"png":  "image/png",
+		"ico":  "image/x-icon",
+		"webp": "image/webp",
+		"jpeg": "image/jpeg",
+	}
+
+	// negotiableFormats lists the output formats considered for the Accept
+	// header, most preferred first.
+	negotiableFormats = []string{"png", "webp", "jpeg", "ico"}
+
+	// fallbackModes are the built-in values accepted by the fallback query
+	// parameter; an allowlisted URL is accepted as well.
+	fallbackModes = []string{"default", "404", "blank", "letter"}
+
+	// iconSizes are the values accepted by the size query parameter.
+	iconSizes = []int{16, 32, 48, 64, 96, 128, 180, 192, 256}
+
 	pageTemplates = mustParseTemplates()
 )
 
@@ -76,11 +165,14 @@ type PageData struct {
 }
 
 type DomainEntry struct {
-	ID          int    `json:"id"`
-	Domain      string `json:"domain"`
-	DataSize    int    `json:"data_size"`
-	ContentType string `json:"content_type"`
-	CreatedAt   string `json:"created_at"`
+	ID           int    `json:"id"`
+	Domain       string `json:"domain"`
+	DataSize     int    `json:"data_size"`
+	ContentType  string `json:"content_type"`
+	Origin       string `json:"origin"`
+	DeclaredType string `json:"declared_content_type"`
+	CreatedAt    string `json:"created_at"`
+	ExpiresAt    string `json:"expires_at"`
 }
 
 type DomainsPageData struct {
@@ -88,11 +180,70 @@ type DomainsPageData struct {
 	Domains []DomainEntry
 }
 
+type DiscoveryMetrics struct {
+	Started        atomic.Int64
+	Coalesced      atomic.Int64
+	TypeMismatches atomic.Int64
+}
+
+type RenderMetrics struct {
+	VariantLookups atomic.Int64
+	Renders        atomic.Int64
+}
+
+// discoveryWaiters tracks the callers waiting on a coalesced discovery and
+// cancels it when the last one leaves.
+type discoveryWaiters struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	count  int
+}
+
+type FaviconCandidate struct {
+	URL      string
+	Priority int
+	Rel      []string
+	Sizes    string
+	Type     string
+	Media    string
+	Purpose  string
+}
+
 type FaviconResult struct {
-	Data        []byte
-	ContentType string
-	URL         string
-	Error       error
+	Data         []byte
+	ContentType  string
+	DeclaredType string
+	URL          string
+	Origin       string
+	Width        int
+	Height       int
+	Score        int
+	Candidate    FaviconCandidate
+	FetchedAt    time.Time
+	Error        error
+}
+
+type CachedFavicon struct {
+	Data         []byte
+	ContentType  string
+	DeclaredType string
+	Origin       string
+	Score        *int
+	Hash         string
+	FetchedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+func (f *CachedFavicon) IsStale(now time.Time) bool {
+	return !now.Before(f.ExpiresAt)
+}
+
+type FailedLookup struct {
+	Domain      string
+	Reason      string
+	Attempts    int
+	AttemptedAt time.Time
+	RetryAfter  time.Time
 }
 
 type Manifest struct {
@@ -100,13 +251,30 @@ type Manifest struct {
 }
 
 type ManifestIcon struct {
-	Src   string `json:"src"`
-	Sizes string `json:"sizes"`
-	Type  string `json:"type"`
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose"`
+}
+
+type HTMLLinks struct {
+	URL      string
+	Icons    []FaviconCandidate
+	Manifest string
+}
+
+// OutboundPolicy decides which addresses the fetcher may connect to. Private,
+// loopback, link-local and other non-public ranges are denied unless the host
+// name or address range is explicitly allowed.
+type OutboundPolicy struct {
+	allowedHosts    map[string]bool
+	allowedPrefixes []netip.Prefix
 }
 
 type FaviconRepository struct {
-	db *sql.DB
+	db         *sql.DB
+	ttl        time.Duration
+	failureTTL time.Duration
 }
 
 func NewFaviconRepository(dbPath string) (*FaviconRepository, error) {
@@ -148,30 +316,215 @@ func NewFaviconRepository(dbPath string) (*FaviconRepository, error) {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
-	return &FaviconRepository{db: db}, nil
+	repo := &FaviconRepository{db: db, ttl: faviconTTL, failureTTL: failureTTL}
+	if err := repo.backfillHashes(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// backfillHashes stores the hash of favicons cached before hashes were kept,
+// so every entry's ETag is known without reading its data.
+func (r *FaviconRepository) backfillHashes() error {
+	rows, err := r.db.Query(`SELECT domain, data FROM favicons WHERE data_hash IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill favicon hashes: %w", err)
+	}
+
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var domain string
+		var data []byte
+		if err := rows.Scan(&domain, &data); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to backfill favicon hashes: %w", err)
+		}
+		hashes[domain] = contentHash(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to backfill favicon hashes: %w", err)
+	}
+
+	for domain, hash := range hashes {
+		if _, err := r.db.Exec(`UPDATE favicons SET data_hash = ? WHERE domain = ?`, hash, domain); err != nil {
+			return fmt.Errorf("failed to backfill favicon hashes: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetEntry returns the cached favicon for domain whether or not it has
+// expired, so callers can serve stale data while a refresh runs.
+func (r *FaviconRepository) GetEntry(domain string) (*CachedFavicon, error) {
+	return r.getEntry(domain, true)
+}
+
+// GetEntryMeta is GetEntry without the favicon data, for answering
+// conditional and HEAD requests without reading it.
+func (r *FaviconRepository) GetEntryMeta(domain string) (*CachedFavicon, error) {
+	return r.getEntry(domain, false)
+}
+
+func (r *FaviconRepository) getEntry(domain string, withData bool) (*CachedFavicon, error) {
+	var entry CachedFavicon
+	var origin, hash sql.NullString
+	var score sql.NullInt64
+	var fetchedAt, expiresAt sql.NullTime
+
+	columns := `content_type, origin, score, data_hash, fetched_at, expires_at`
+	dest := []any{&entry.ContentType, &origin, &score, &hash, &fetchedAt, &expiresAt}
+	if withData {
+		columns += `, data`
+		dest = append(dest, &entry.Data)
+	}
+
+	query := `SELECT ` + columns + ` FROM favicons WHERE domain = ?`
+	err := r.db.QueryRow(query, domain).Scan(dest...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get favicon: %w", err)
+	}
+
+	entry.Origin = origin.String
+	entry.Hash = hash.String
+	if score.Valid {
+		value := int(score.Int64)
+		entry.Score = &value
+	}
+	entry.FetchedAt = fetchedAt.Time
+	entry.ExpiresAt = expiresAt.Time
+
+	return &entry, nil
+}
+
+// SaveEntry stores entry for domain, stamping its fetch time and expiry, and
+// drops any variants rendered from the previous favicon.
+func (r *FaviconRepository) SaveEntry(domain string, entry *CachedFavicon) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	entry.FetchedAt, entry.ExpiresAt = now, now.Add(r.ttl)
+	entry.Hash = contentHash(entry.Data)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to save favicon: %w", err)
+	}
+	defer tx.Rollback()
+
+	var declaredType sql.NullString
+	if entry.DeclaredType != "" {
+		declaredType = sql.NullString{String: entry.DeclaredType, Valid: true}
+	}
+
+	var score sql.NullInt64
+	if entry.Score != nil {
+		score = sql.NullInt64{Int64: int64(*entry.Score), Valid: true}
+	}
+
+	query := `INSERT OR REPLACE INTO favicons (domain, data, data_hash, content_type, declared_content_type, origin, score, fetched_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, domain, entry.Data, entry.Hash, entry.ContentType, declaredType, entry.Origin, score, formatTimestamp(entry.FetchedAt), formatTimestamp(entry.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to save favicon: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM favicon_variants WHERE domain = ?`, domain); err != nil {
+		return fmt.Errorf("failed to clear favicon variants: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save favicon: %w", err)
+	}
+	return nil
 }
 
-func (r *FaviconRepository) Get(domain string) ([]byte, string, error) {
+// GetVariant returns the rendition of domain's favicon in format at size,
+// provided it was derived from the original with the given hash.
+func (r *FaviconRepository) GetVariant(domain, hash, format string, size int) ([]byte, string, error) {
 	var data []byte
 	var contentType string
 
-	query := `SELECT data, content_type FROM favicons WHERE domain = ?`
-	err := r.db.QueryRow(query, domain).Scan(&data, &contentType)
+	query := `SELECT data, content_type FROM favicon_variants WHERE domain = ? AND original_hash = ? AND format = ? AND size = ?`
+	err := r.db.QueryRow(query, domain, hash, format, size).Scan(&data, &contentType)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, "", ErrNotFound
 		}
-		return nil, "", fmt.Errorf("failed to get favicon: %w", err)
+		return nil, "", fmt.Errorf("failed to get favicon variant: %w", err)
 	}
 
 	return data, contentType, nil
 }
 
-func (r *FaviconRepository) Save(domain string, data []byte, contentType string) error {
-	query := `INSERT OR REPLACE INTO favicons (domain, data, content_type) VALUES (?, ?, ?)`
-	_, err := r.db.Exec(query, domain, data, contentType)
+// SaveVariant stores a rendition derived from the original with the given
+// hash. A request may still be rendering from an original that a refresh has
+// since replaced, so the hash keeps such a rendition from being served for
+// the new one.
+func (r *FaviconRepository) SaveVariant(domain, hash, format string, size int, data []byte, contentType string) error {
+	query := `INSERT OR REPLACE INTO favicon_variants (domain, original_hash, format, size, data, content_type) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := r.db.Exec(query, domain, hash, format, size, data, contentType)
 	if err != nil {
-		return fmt.Errorf("failed to save favicon: %w", err)
+		return fmt.Errorf("failed to save favicon variant: %w", err)
+	}
+	return nil
+}
+
+// Postpone pushes back the expiry of a cached favicon without touching its
+// data, used when a refresh fails so the stale copy is not retried on every hit.
+func (r *FaviconRepository) Postpone(domain string, delay time.Duration) error {
+	query := `UPDATE favicons SET expires_at = ? WHERE domain = ?`
+	_, err := r.db.Exec(query, formatTimestamp(time.Now().Add(delay)), domain)
+	if err != nil {
+		return fmt.Errorf("failed to postpone favicon expiry: %w", err)
+	}
+	return nil
+}
+
+// GetFailure returns the negative cache entry for domain if its retry window
+// has not passed yet.
+func (r *FaviconRepository) GetFailure(domain string) (*FailedLookup, error) {
+	failure := FailedLookup{Domain: domain}
+
+	query := `SELECT reason, attempts, attempted_at, retry_after FROM failed_lookups WHERE domain = ? AND retry_after > ?`
+	err := r.db.QueryRow(query, domain, formatTimestamp(time.Now())).Scan(&failure.Reason, &failure.Attempts, &failure.AttemptedAt, &failure.RetryAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get failed lookup: %w", err)
+	}
+
+	return &failure, nil
+}
+
+// SaveFailure records a failed lookup for domain. Each consecutive failure
+// doubles the retry window, up to maxFailureBackoff.
+func (r *FaviconRepository) SaveFailure(domain, reason string) error {
+	var attempts int
+	err := r.db.QueryRow(`SELECT attempts FROM failed_lookups WHERE domain = ?`, domain).Scan(&attempts)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get failed lookup: %w", err)
+	}
+	attempts++
+
+	now := time.Now()
+	retryAfter := now.Add(failureBackoff(r.failureTTL, attempts))
+
+	query := `INSERT OR REPLACE INTO failed_lookups (domain, reason, attempts, attempted_at, retry_after) VALUES (?, ?, ?, ?, ?)`
+	_, err = r.db.Exec(query, domain, reason, attempts, formatTimestamp(now), formatTimestamp(retryAfter))
+	if err != nil {
+		return fmt.Errorf("failed to save failed lookup: %w", err)
+	}
+	return nil
+}
+
+func (r *FaviconRepository) ClearFailure(domain string) error {
+	_, err := r.db.Exec(`DELETE FROM failed_lookups WHERE domain = ?`, domain)
+	if err != nil {
+		return fmt.Errorf("failed to clear failed lookup: %w", err)
 	}
 	return nil
 }
@@ -184,7 +537,10 @@ func (r *FaviconRepository) List() (string, error) {
 				'domain', domain,
 				'data_size', length(data),
 				'content_type', content_type,
-				'created_at', created_at
+				'declared_content_type', declared_content_type,
+				'origin', origin,
+				'created_at', created_at,
+				'expires_at', expires_at
 			)
 		)
 		FROM favicons
@@ -215,6 +571,112 @@ func (r *FaviconRepository) Close() error {
 	return r.db.Close()
 }
 
+func failureBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxFailureBackoff)
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+
+	return d
+}
+
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: Invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+
+	return b
+}
+
+func envFallback(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	if !isValidFallback(value) {
+		log.Printf("Warning: Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+
+	return value
+}
+
+// parseHostList parses a comma-separated list of host names.
+func parseHostList(list string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), ".")); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// isValidFallback reports whether fallback is one of the fallback modes or an
+// absolute http(s) URL on a host listed in FAVICON_FALLBACK_HOSTS.
+func isValidFallback(fallback string) bool {
+	if slices.Contains(fallbackModes, fallback) {
+		return true
+	}
+
+	u, err := url.Parse(fallback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+
+	return fallbackHosts[strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))]
+}
+
+// resamplers maps the accepted FAVICON_RESAMPLER values to interpolators,
+// from fastest to smoothest.
+var resamplers = map[string]draw.Interpolator{
+	"nearest":        draw.NearestNeighbor,
+	"approxbilinear": draw.ApproxBiLinear,
+	"bilinear":       draw.BiLinear,
+	"catmullrom":     draw.CatmullRom,
+}
+
+func envResampler(key, fallback string) draw.Interpolator {
+	value := strings.ToLower(os.Getenv(key))
+	if value == "" {
+		return resamplers[fallback]
+	}
+
+	interpolator, ok := resamplers[value]
+	if !ok {
+		log.Printf("Warning: Invalid %s %q, using %s", key, value, fallback)
+		return resamplers[fallback]
+	}
+
+	return interpolator
+}
+
 func applyPragmas(db *sql.DB) error {
 	pragmas := []string{
 		"PRAGMA journal_mode=WAL",
@@ -247,10 +709,124 @@ func runMigrations(db *sql.DB) error {
 	return nil
 }
 
+// blockedPrefixes are non-public ranges not already covered by the netip.Addr
+// IsPrivate/IsLoopback/IsLinkLocal*/IsMulticast/IsUnspecified checks.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can embed private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001:10::/28"),    // deprecated ORCHID
+	netip.MustParsePrefix("2002::/16"),       // 6to4, can embed private IPv4
+	netip.MustParsePrefix("2001::/32"),       // Teredo, can embed private IPv4
+	netip.MustParsePrefix("::ffff:0:0:0/96"), // IPv4-translated
+}
+
+// newOutboundPolicy parses a comma-separated allowlist of host names, IP
+// addresses and CIDR ranges that may be fetched even though they are not public.
+func newOutboundPolicy(allowlist string) *OutboundPolicy {
+	policy := &OutboundPolicy{allowedHosts: make(map[string]bool)}
+
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			policy.allowedPrefixes = append(policy.allowedPrefixes, prefix.Masked())
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			policy.allowedPrefixes = append(policy.allowedPrefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		policy.allowedHosts[strings.TrimSuffix(entry, ".")] = true
+	}
+
+	return policy
+}
+
+func (p *OutboundPolicy) AllowsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, prefix := range p.allowedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DialContext dials addr, checking the resolved IP of every connection
+// attempt (including each redirect hop) unless the host name is allowlisted.
+func (p *OutboundPolicy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: httpTimeout}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.allowedHosts[strings.ToLower(strings.TrimSuffix(host, "."))] {
+		dialer.Control = p.control
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (p *OutboundPolicy) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !p.AllowsAddr(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+
+	return nil
+}
+
 func newHTTPClient() *http.Client {
 	return &http.Client{
 		Timeout: httpTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
 		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return outbound.DialContext(ctx, network, addr)
+			},
 			MaxIdleConns:          maxIdleConns,
 			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
 			MaxConnsPerHost:       maxConnsPerHost,
@@ -266,318 +842,1739 @@ func newHTTPClient() *http.Client {
 	}
 }
 
-func extractDomain(rawURL string) string {
-	u := rawURL
-	u = strings.TrimPrefix(u, "https://")
-	u = strings.TrimPrefix(u, "http://")
-
-	if idx := strings.IndexByte(u, '/'); idx != -1 {
-		u = u[:idx]
+// extractDomain returns the cache key for rawURL: the host in lowercase
+// ASCII (punycode) form without a trailing dot, with a non-default port kept,
+// prefixed with the scheme when one was given. Keys without a scheme are
+// discovered over HTTPS first, then HTTP. An explicit http:// is rejected
+// when plain HTTP is disabled.
+func extractDomain(rawURL string) (string, error) {
+	raw := strings.TrimSpace(rawURL)
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
 	}
 
-	if idx := strings.IndexByte(u, ':'); idx != -1 {
-		u = u[:idx]
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidHost, err)
 	}
 
-	if u == "" {
-		return rawURL
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("%w: unsupported scheme %q", ErrInvalidHost, u.Scheme)
 	}
-
-	return strings.ToLower(u)
-}
-
-func normalizeIconURL(baseURL, iconURL string) string {
-	if strings.HasPrefix(iconURL, "./") {
-		iconURL = strings.TrimPrefix(iconURL, ".")
+	if scheme == "http" && !allowHTTP {
+		return "", fmt.Errorf("%w: plain HTTP is disabled", ErrInvalidHost)
 	}
 
-	if strings.HasPrefix(iconURL, "http://") || strings.HasPrefix(iconURL, "https://") {
-		return iconURL
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
 	}
 
-	if strings.HasPrefix(iconURL, "/") {
-		return baseURL + iconURL
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("%w: invalid port %q", ErrInvalidHost, port)
+		}
 	}
-
-	return baseURL + "/" + iconURL
-}
-
-func getFaviconURLs(baseURL, domain string) [][]string {
-	groups := [][]string{
-		{
-			baseURL + "/favicon.ico",
-			baseURL + "/favicon.png",
-			baseURL + "/favicon.svg",
-			baseURL + "/" + domain + ".ico",
-			baseURL + "/" + domain + ".png",
-		},
-		{
-			baseURL + "/apple-touch-icon.png",
-			baseURL + "/apple-touch-icon-precomposed.png",
-		},
-		{
-			baseURL + "/apple-touch-icon-180x180.png",
-			baseURL + "/apple-touch-icon-152x152.png",
-			baseURL + "/apple-touch-icon-120x120.png",
-		},
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		port = ""
 	}
 
-	if manifestIcons := getManifestIcons(baseURL); len(manifestIcons) > 0 {
-		groups = append(groups, manifestIcons)
+	domain := host
+	if port != "" {
+		domain = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		domain = "[" + host + "]"
 	}
 
-	if htmlIcons := getHTMLIconLinks(baseURL); len(htmlIcons) > 0 {
-		groups = append(groups, htmlIcons)
+	if scheme != "" {
+		return scheme + "://" + domain, nil
 	}
-
-	return groups
+	return domain, nil
 }
 
-func getManifestIcons(baseURL string) []string {
-	resp, err := httpClient.Get(baseURL + "/manifest.json")
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil
+// normalizeHost validates a hostname or IP literal and converts
+// internationalized names to their punycode form.
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return "", fmt.Errorf("%w: missing host", ErrInvalidHost)
 	}
-	defer resp.Body.Close()
 
-	var manifest Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
-		return nil
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Zone() != "" {
+			return "", fmt.Errorf("%w: zoned address %q", ErrInvalidHost, host)
+		}
+		return addr.String(), nil
 	}
 
-	icons := make([]string, 0, len(manifest.Icons))
-	for _, icon := range manifest.Icons {
-		iconURL := icon.Src
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidHost, err)
+	}
 
-		parsed, err := url.Parse(iconURL)
-		if err == nil && parsed.IsAbs() {
-			icons = append(icons, iconURL)
-			continue
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("%w: invalid label in %q", ErrInvalidHost, host)
 		}
+	}
+
+	return ascii, nil
+}
 
-		icons = append(icons, normalizeIconURL(baseURL, iconURL))
+// discoveryBaseURLs returns the base URLs to try, in order, for a cache key
+// produced by extractDomain.
+func discoveryBaseURLs(domain string) []string {
+	if strings.HasPrefix(domain, "http://") || strings.HasPrefix(domain, "https://") {
+		return []string{domain}
 	}
 
-	return icons
+	baseURLs := []string{"https://" + domain}
+	if allowHTTP {
+		baseURLs = append(baseURLs, "http://"+domain)
+	}
+
+	return baseURLs
 }
 
-func getHTMLIconLinks(baseURL string) []string {
-	resp, err := httpClient.Get(baseURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil
+// resolveIconURL resolves an icon reference against the URL of the document it
+// appeared in (page, manifest or redirect target) using RFC 3986 reference
+// resolution. It returns "" for references that are not fetchable over HTTP.
+func resolveIconURL(documentURL, iconURL string) string {
+	base, err := url.Parse(documentURL)
+	if err != nil {
+		return ""
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTMLReadSize))
+	ref, err := url.Parse(strings.TrimSpace(iconURL))
 	if err != nil {
-		return nil
+		return ""
 	}
 
-	return parseIconLinks(string(body), baseURL)
-}
+	resolved := base.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
 
-func parseIconLinks(html, baseURL string) []string {
-	var icons []string
-	htmlLower := strings.ToLower(html)
-	offset := 0
+	return resolved.String()
+}
 
-	for {
-		idx := strings.Index(htmlLower[offset:], "<link")
-		if idx == -1 {
-			break
-		}
-		offset += idx
+// buildFaviconCandidates returns the prioritized candidate groups for a site.
+// When the homepage redirected to another origin, the well-known paths are
+// probed on that final origin as well as on the requested one.
+func buildFaviconCandidates(ctx context.Context, baseURL, domain string, page HTMLLinks) [][]FaviconCandidate {
+	groups := wellKnownFaviconURLs(baseURL, domain)
+	manifestBases := []string{baseURL}
 
-		end := strings.Index(htmlLower[offset:], ">")
-		if end == -1 {
-			break
+	if origin, host := urlOrigin(page.URL); origin != "" && origin != baseURL {
+		for i, group := range wellKnownFaviconURLs(origin, host) {
+			groups[i] = append(group, groups[i]...)
 		}
+		manifestBases = []string{origin, baseURL}
+	}
 
-		tag := html[offset : offset+end+1]
+	if manifestIcons := discoverManifestIcons(ctx, manifestBases, page.Manifest); len(manifestIcons) > 0 {
+		groups = append(groups, manifestIcons)
+	}
+
+	if len(page.Icons) > 0 {
+		groups = append(groups, page.Icons)
+	}
+
+	for priority, group := range groups {
+		for i := range group {
+			group[i].Priority = priority
+		}
+	}
+
+	return groups
+}
+
+func wellKnownFaviconURLs(baseURL, domain string) [][]FaviconCandidate {
+	return [][]FaviconCandidate{
+		{
+			{URL: baseURL + "/favicon.ico"},
+			{URL: baseURL + "/favicon.png"},
+			{URL: baseURL + "/favicon.svg"},
+			{URL: baseURL + "/" + domain + ".ico"},
+			{URL: baseURL + "/" + domain + ".png"},
+		},
+		{
+			{URL: baseURL + "/apple-touch-icon.png", Sizes: "180x180"},
+			{URL: baseURL + "/apple-touch-icon-precomposed.png", Sizes: "180x180"},
+		},
+		{
+			{URL: baseURL + "/apple-touch-icon-180x180.png", Sizes: "180x180"},
+			{URL: baseURL + "/apple-touch-icon-152x152.png", Sizes: "152x152"},
+			{URL: baseURL + "/apple-touch-icon-120x120.png", Sizes: "120x120"},
+		},
+	}
+}
+
+// urlOrigin returns the scheme://host[:port] origin of rawURL and its hostname.
+func urlOrigin(rawURL string) (string, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", ""
+	}
+
+	return u.Scheme + "://" + u.Host, u.Hostname()
+}
+
+// discoverManifestIcons returns the icons of the manifest declared by the
+// homepage, or when it declares none, of the first common manifest location
+// that exists, trying each of baseURLs in order.
+func discoverManifestIcons(ctx context.Context, baseURLs []string, declaredURL string) []FaviconCandidate {
+	if declaredURL != "" {
+		return getManifestIcons(ctx, declaredURL)
+	}
+
+	var fallbacks []string
+	for _, baseURL := range baseURLs {
+		fallbacks = append(fallbacks,
+			baseURL+"/site.webmanifest",
+			baseURL+"/manifest.webmanifest",
+			baseURL+"/manifest.json",
+		)
+	}
+
+	results := make([][]FaviconCandidate, len(fallbacks))
+	var wg sync.WaitGroup
+	for i, manifestURL := range fallbacks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = getManifestIcons(ctx, manifestURL)
+		}()
+	}
+	wg.Wait()
+
+	for _, icons := range results {
+		if len(icons) > 0 {
+			return icons
+		}
+	}
+
+	return nil
+}
+
+func getManifestIcons(ctx context.Context, manifestURL string) []FaviconCandidate {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil
+	}
+
+	manifestURL = resp.Request.URL.String()
+
+	icons := make([]FaviconCandidate, 0, len(manifest.Icons))
+	for _, icon := range manifest.Icons {
+		iconURL := resolveIconURL(manifestURL, icon.Src)
+		if iconURL == "" {
+			continue
+		}
+
+		icons = append(icons, FaviconCandidate{
+			URL:     iconURL,
+			Sizes:   icon.Sizes,
+			Type:    icon.Type,
+			Purpose: icon.Purpose,
+		})
+	}
+
+	return icons
+}
+
+// getHTMLLinks fetches the homepage, following redirects, and parses its links
+// relative to the final document URL.
+func getHTMLLinks(ctx context.Context, baseURL string) HTMLLinks {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	if err != nil {
+		return HTMLLinks{}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return HTMLLinks{}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return HTMLLinks{}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTMLReadSize))
+	if err != nil {
+		return HTMLLinks{}
+	}
+
+	return parseHTMLLinks(string(body), resp.Request.URL.String())
+}
+
+// parseHTMLLinks tokenizes an HTML document and returns its icon <link>s as
+// candidates along with its manifest link, with hrefs resolved against the
+// document's <base href> (if any) and pageURL.
+func parseHTMLLinks(document, pageURL string) HTMLLinks {
+	base := pageURL
+
+	var links []html.Token
+	baseFound := false
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		switch token.DataAtom {
+		case atom.Base:
+			// Only the first <base href> counts, and it applies to the whole document.
+			if href := tokenAttribute(token, "href"); href != "" && !baseFound {
+				if resolved := resolveIconURL(pageURL, href); resolved != "" {
+					base = resolved
+					baseFound = true
+				}
+			}
+		case atom.Link:
+			links = append(links, token)
+		}
+	}
+
+	result := HTMLLinks{URL: pageURL}
+	for _, link := range links {
+		href := tokenAttribute(link, "href")
+		if href == "" {
+			continue
+		}
+
+		rel := strings.Fields(strings.ToLower(tokenAttribute(link, "rel")))
+		if slices.Contains(rel, "manifest") {
+			if result.Manifest == "" {
+				result.Manifest = resolveIconURL(base, href)
+			}
+			continue
+		}
+
+		if !isIconLink(rel) {
+			continue
+		}
+
+		iconURL := resolveIconURL(base, href)
+		if iconURL == "" {
+			continue
+		}
+
+		result.Icons = append(result.Icons, FaviconCandidate{
+			URL:   iconURL,
+			Rel:   rel,
+			Sizes: tokenAttribute(link, "sizes"),
+			Type:  tokenAttribute(link, "type"),
+			Media: tokenAttribute(link, "media"),
+		})
+	}
+
+	return result
+}
+
+func isIconLink(rel []string) bool {
+	isIcon := false
+	for _, token := range rel {
+		switch token {
+		case "preload", "modulepreload", "dns-prefetch", "preconnect", "prefetch":
+			return false
+		}
+		if strings.Contains(token, "icon") {
+			isIcon = true
+		}
+	}
+
+	return isIcon
+}
+
+func tokenAttribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Namespace == "" && attr.Key == name {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+type icoEntry struct {
+	width    int
+	height   int
+	bitCount int
+	offset   int
+	size     int
+}
+
+var (
+	errInvalidICO = errors.New("invalid ICO data")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+	image.RegisterFormat("cur", "\x00\x00\x02\x00", decodeICO, decodeICOConfig)
+}
+
+func isICOType(contentType string) bool {
+	contentType = strings.ToLower(strings.Split(contentType, ";")[0])
+
+	switch contentType {
+	case "image/x-icon", "image/vnd.microsoft.icon", "image/icon", "image/ico":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseICOEntries reads the directory of an ICO or CUR container. Entries
+// whose image data runs past the end of the file mean the file was
+// truncated, and are rejected.
+func parseICOEntries(data []byte) ([]icoEntry, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint16(data[0:]) != 0 {
+		return nil, errInvalidICO
+	}
+
+	kind := binary.LittleEndian.Uint16(data[2:])
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if (kind != 1 && kind != 2) || count == 0 || len(data) < 6+16*count {
+		return nil, errInvalidICO
+	}
+
+	entries := make([]icoEntry, 0, count)
+	for i := range count {
+		dir := data[6+16*i:]
+
+		entry := icoEntry{
+			width:    int(dir[0]),
+			height:   int(dir[1]),
+			bitCount: int(binary.LittleEndian.Uint16(dir[6:])),
+			size:     int(binary.LittleEndian.Uint32(dir[8:])),
+			offset:   int(binary.LittleEndian.Uint32(dir[12:])),
+		}
+		if entry.width == 0 {
+			entry.width = 256
+		}
+		if entry.height == 0 {
+			entry.height = 256
+		}
+		if kind == 2 {
+			// Cursor entries store the hotspot here instead of the bit depth.
+			entry.bitCount = 0
+		}
+
+		if entry.size <= 0 || entry.offset > len(data) || entry.size > len(data)-entry.offset {
+			return nil, fmt.Errorf("%w: entry %d is truncated", errInvalidICO, i)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// selectICOEntry picks the smallest entry at least size pixels wide, or the
+// largest one when none is big enough. Ties go to the higher bit depth.
+func selectICOEntry(entries []icoEntry, size int) icoEntry {
+	best := entries[0]
+	for _, entry := range entries[1:] {
+		bestFits := best.width >= size
+		entryFits := entry.width >= size
+
+		switch {
+		case entryFits && !bestFits:
+			best = entry
+		case entryFits && bestFits && entry.width < best.width:
+			best = entry
+		case !entryFits && !bestFits && entry.width > best.width:
+			best = entry
+		case entry.width == best.width && entry.bitCount > best.bitCount:
+			best = entry
+		}
+	}
+
+	return best
+}
+
+func decodeICOSize(data []byte, size int) (image.Image, error) {
+	entries, err := parseICOEntries(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := selectICOEntry(entries, size)
+	raw := data[entry.offset : entry.offset+entry.size]
+
+	if bytes.HasPrefix(raw, pngSignature) {
+		// The directory caps entries at 256px, but the embedded PNG carries
+		// its own dimensions.
+		return decodeImage(raw)
+	}
+
+	return decodeDIB(raw)
+}
+
+func decodeICO(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeICOSize(data, scalableIconSize)
+}
+
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageSize))
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	entries, err := parseICOEntries(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	entry := selectICOEntry(entries, scalableIconSize)
+
+	return image.Config{ColorModel: color.NRGBAModel, Width: entry.width, Height: entry.height}, nil
+}
+
+// decodeDIB decodes the headerless BMP stored in ICO entries: a
+// BITMAPINFOHEADER, an optional palette, the color (XOR) bitmap and a 1-bit
+// transparency (AND) mask, with the height field covering both bitmaps.
+func decodeDIB(raw []byte) (image.Image, error) {
+	if len(raw) < 40 {
+		return nil, errInvalidICO
+	}
+
+	headerSize := int(binary.LittleEndian.Uint32(raw[0:]))
+	width := int(int32(binary.LittleEndian.Uint32(raw[4:])))
+	height := int(int32(binary.LittleEndian.Uint32(raw[8:]))) / 2
+	bitCount := int(binary.LittleEndian.Uint16(raw[14:]))
+	compression := binary.LittleEndian.Uint32(raw[16:])
+	colorsUsed := int(binary.LittleEndian.Uint32(raw[32:]))
+
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+
+	if headerSize < 40 || headerSize > len(raw) || width <= 0 || height <= 0 || width > 256 || height > 256 {
+		return nil, errInvalidICO
+	}
+
+	const biRGB, biBitfields = 0, 3
+	if compression != biRGB && !(compression == biBitfields && bitCount == 32) {
+		return nil, fmt.Errorf("%w: unsupported compression %d", errInvalidICO, compression)
+	}
+
+	offset := headerSize
+	if compression == biBitfields && headerSize == 40 {
+		offset += 12
+	}
+
+	var palette []color.NRGBA
+	switch bitCount {
+	case 1, 4, 8:
+		if colorsUsed == 0 || colorsUsed > 1<<bitCount {
+			colorsUsed = 1 << bitCount
+		}
+		if len(raw) < offset+4*colorsUsed {
+			return nil, errInvalidICO
+		}
+		palette = make([]color.NRGBA, colorsUsed)
+		for i := range palette {
+			c := raw[offset+4*i:]
+			palette[i] = color.NRGBA{R: c[2], G: c[1], B: c[0], A: 0xff}
+		}
+		offset += 4 * colorsUsed
+	case 24, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported bit depth %d", errInvalidICO, bitCount)
+	}
+
+	xorStride := (width*bitCount + 31) / 32 * 4
+	andStride := (width + 31) / 32 * 4
+	if len(raw) < offset+xorStride*height {
+		return nil, errInvalidICO
+	}
+
+	row := func(data []byte, stride, y int) []byte {
+		if !topDown {
+			y = height - 1 - y
+		}
+		return data[y*stride : (y+1)*stride]
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xor := raw[offset:]
+	hasAlpha := false
+
+	for y := range height {
+		pixels := row(xor, xorStride, y)
+		for x := range width {
+			var c color.NRGBA
+			switch bitCount {
+			case 1:
+				c = paletteColor(palette, int(pixels[x/8]>>(7-x%8)&0x01))
+			case 4:
+				c = paletteColor(palette, int(pixels[x/2]>>(4*(1-x%2))&0x0f))
+			case 8:
+				c = paletteColor(palette, int(pixels[x]))
+			case 24:
+				c = color.NRGBA{R: pixels[3*x+2], G: pixels[3*x+1], B: pixels[3*x], A: 0xff}
+			case 32:
+				c = color.NRGBA{R: pixels[4*x+2], G: pixels[4*x+1], B: pixels[4*x], A: pixels[4*x+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	// 32-bit entries carry their own alpha; everything else (and 32-bit
+	// entries whose alpha channel is empty) relies on the AND mask.
+	mask := xor[xorStride*height:]
+	if !hasAlpha && len(mask) >= andStride*height {
+		for y := range height {
+			bits := row(mask, andStride, y)
+			for x := range width {
+				c := img.NRGBAAt(x, y)
+				c.A = 0xff
+				if bits[x/8]>>(7-x%8)&0x01 == 1 {
+					c.A = 0
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func paletteColor(palette []color.NRGBA, index int) color.NRGBA {
+	if index >= len(palette) {
+		return color.NRGBA{A: 0xff}
+	}
+	return palette[index]
+}
+
+// encodeICO writes img as a single-entry ICO container with a PNG payload.
+func encodeICO(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	if bounds.Dx() > 256 || bounds.Dy() > 256 {
+		return fmt.Errorf("ICO images are limited to 256x256, got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	var payload bytes.Buffer
+	if err := png.Encode(&payload, img); err != nil {
+		return err
+	}
+
+	header := make([]byte, 6+16)
+	binary.LittleEndian.PutUint16(header[2:], 1)
+	binary.LittleEndian.PutUint16(header[4:], 1)
+	// A width or height of 256 wraps to 0, which is how ICO spells 256.
+	header[6] = byte(bounds.Dx())
+	header[7] = byte(bounds.Dy())
+	binary.LittleEndian.PutUint16(header[10:], 1)
+	binary.LittleEndian.PutUint16(header[12:], 32)
+	binary.LittleEndian.PutUint32(header[14:], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(header[18:], uint32(len(header)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := payload.WriteTo(w)
+	return err
+}
+
+// flattenImage composites img onto a white background, for formats without
+// transparency.
+func flattenImage(img image.Image) image.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// avatarFont is the typeface letter avatars are rasterized with.
+var avatarFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// domainHost strips the scheme from a cache key, so avatars look the same
+// however the domain was requested.
+func domainHost(domain string) string {
+	if _, host, ok := strings.Cut(domain, "://"); ok {
+		return host
+	}
+	return domain
+}
+
+// avatarLetter picks the character shown on a domain's letter avatar: the
+// first letter or digit of its host, skipping a leading "www.".
+func avatarLetter(domain string) string {
+	host := strings.TrimPrefix(domainHost(domain), "www.")
+	if unicodeHost, err := idna.ToUnicode(host); err == nil {
+		host = unicodeHost
+	}
+
+	for _, r := range host {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return strings.ToUpper(string(r))
+		}
+	}
+
+	return "?"
+}
+
+// avatarColor derives a background color from a hash of domain, so a site
+// keeps the same color across requests and servers.
+func avatarColor(domain string) color.NRGBA {
+	hash := fnv.New32a()
+	hash.Write([]byte(domainHost(domain)))
+	return hslColor(float64(hash.Sum32()%360), 0.55, 0.45)
+}
+
+func hslColor(hue, saturation, lightness float64) color.NRGBA {
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := lightness - chroma/2
+
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+
+	channel := func(v float64) uint8 { return uint8(math.Round((v + m) * 255)) }
+	return color.NRGBA{R: channel(r), G: channel(g), B: channel(b), A: 0xff}
+}
+
+func renderLetterSVG(letter string, background color.NRGBA, size int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 100 100">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="100" height="100" fill="#%02x%02x%02x"/>`, background.R, background.G, background.B)
+	buf.WriteString(`<text x="50" y="50" dy="0.35em" text-anchor="middle" font-family="Helvetica, Arial, sans-serif" font-size="64" font-weight="bold" fill="#fff">`)
+	xml.EscapeText(&buf, []byte(letter))
+	buf.WriteString(`</text></svg>`)
+	return buf.Bytes()
+}
+
+// renderLetterImage draws letter centered in white on a size x size square.
+// Characters missing from the font are drawn as "?".
+func renderLetterImage(letter string, background color.NRGBA, size int) (image.Image, error) {
+	typeface, err := avatarFont()
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(typeface, &opentype.FaceOptions{Size: float64(size) * 0.64, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	r, _ := utf8.DecodeRuneInString(letter)
+	if _, ok := face.GlyphAdvance(r); !ok {
+		letter = "?"
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	// Center the glyph's ink rather than its advance box, which includes
+	// side bearings and descender space.
+	drawer := font.Drawer{Dst: img, Src: image.White, Face: face}
+	bounds, _ := drawer.BoundString(letter)
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(size)-(bounds.Max.X-bounds.Min.X))/2 - bounds.Min.X,
+		Y: (fixed.I(size)-(bounds.Max.Y-bounds.Min.Y))/2 - bounds.Min.Y,
+	}
+	drawer.DrawString(letter)
+
+	return img, nil
+}
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// svgElements are the SVG elements sanitizeSVG keeps. Anything else,
+// including every element outside the SVG namespace, is dropped with its
+// content.
+var svgElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "symbol": true, "use": true, "a": true, "switch": true,
+	"title": true, "desc": true, "style": true, "image": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true, "polygon": true,
+	"text": true, "tspan": true, "textPath": true,
+	"linearGradient": true, "radialGradient": true, "stop": true, "pattern": true,
+	"clipPath": true, "mask": true, "marker": true,
+	"animate": true, "animateMotion": true, "animateTransform": true, "set": true,
+	"filter": true, "feBlend": true, "feColorMatrix": true, "feComponentTransfer": true, "feComposite": true,
+	"feConvolveMatrix": true, "feDiffuseLighting": true, "feDisplacementMap": true, "feDistantLight": true,
+	"feDropShadow": true, "feFlood": true, "feFuncA": true, "feFuncB": true, "feFuncG": true, "feFuncR": true,
+	"feGaussianBlur": true, "feMerge": true, "feMergeNode": true, "feMorphology": true, "feOffset": true,
+	"fePointLight": true, "feSpecularLighting": true, "feSpotLight": true, "feTile": true, "feTurbulence": true,
+}
+
+// svgAttributes are the attributes sanitizeSVG keeps, besides namespace
+// declarations for SVG and XLink. Their values are still checked by
+// safeSVGAttr.
+var svgAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "lang": true, "version": true, "baseProfile": true,
+	"width": true, "height": true, "viewBox": true, "preserveAspectRatio": true, "transform": true,
+	"x": true, "y": true, "x1": true, "y1": true, "x2": true, "y2": true, "cx": true, "cy": true,
+	"r": true, "rx": true, "ry": true, "fx": true, "fy": true, "fr": true, "d": true, "points": true, "pathLength": true,
+	"fill": true, "fill-opacity": true, "fill-rule": true, "stroke": true, "stroke-width": true,
+	"stroke-linecap": true, "stroke-linejoin": true, "stroke-miterlimit": true, "stroke-dasharray": true,
+	"stroke-dashoffset": true, "stroke-opacity": true, "opacity": true, "color": true, "display": true,
+	"visibility": true, "overflow": true, "paint-order": true, "vector-effect": true, "mix-blend-mode": true,
+	"isolation": true, "shape-rendering": true, "image-rendering": true, "text-rendering": true,
+	"color-interpolation": true, "color-interpolation-filters": true,
+	"clip-path": true, "clip-rule": true, "clipPathUnits": true, "mask": true, "maskUnits": true,
+	"maskContentUnits": true, "filter": true, "filterUnits": true, "primitiveUnits": true,
+	"gradientUnits": true, "gradientTransform": true, "spreadMethod": true, "offset": true,
+	"stop-color": true, "stop-opacity": true, "patternUnits": true, "patternContentUnits": true,
+	"patternTransform": true, "marker-start": true, "marker-mid": true, "marker-end": true,
+	"markerWidth": true, "markerHeight": true, "markerUnits": true, "refX": true, "refY": true, "orient": true,
+	"font-family": true, "font-size": true, "font-weight": true, "font-style": true, "font-variant": true,
+	"text-anchor": true, "dominant-baseline": true, "alignment-baseline": true, "baseline-shift": true,
+	"letter-spacing": true, "word-spacing": true, "text-decoration": true, "dx": true, "dy": true,
+	"rotate": true, "textLength": true, "lengthAdjust": true, "startOffset": true, "method": true,
+	"spacing": true, "media": true, "type": true, "href": true,
+	"in": true, "in2": true, "result": true, "stdDeviation": true, "mode": true, "values": true,
+	"tableValues": true, "slope": true, "intercept": true, "amplitude": true, "exponent": true,
+	"operator": true, "k1": true, "k2": true, "k3": true, "k4": true, "scale": true,
+	"xChannelSelector": true, "yChannelSelector": true, "radius": true, "baseFrequency": true,
+	"numOctaves": true, "seed": true, "stitchTiles": true, "kernelMatrix": true, "order": true,
+	"divisor": true, "bias": true, "targetX": true, "targetY": true, "edgeMode": true,
+	"preserveAlpha": true, "surfaceScale": true, "diffuseConstant": true, "specularConstant": true,
+	"specularExponent": true, "kernelUnitLength": true, "azimuth": true, "elevation": true, "z": true,
+	"pointsAtX": true, "pointsAtY": true, "pointsAtZ": true, "limitingConeAngle": true,
+	"flood-color": true, "flood-opacity": true, "lighting-color": true,
+	"attributeName": true, "attributeType": true, "begin": true, "dur": true, "end": true, "min": true,
+	"max": true, "repeatCount": true, "repeatDur": true, "fill-mode": true, "from": true, "to": true,
+	"by": true, "keyTimes": true, "keySplines": true, "keyPoints": true, "calcMode": true,
+	"additive": true, "accumulate": true, "restart": true, "path": true,
+}
+
+// svgURLAttributes are attributes that load or navigate to a URL. They may
+// only reference fragments of the document or inline raster images.
+var svgURLAttributes = map[string]bool{"href": true, "src": true, "action": true, "formaction": true}
+
+// svgNamespaces tracks the namespace declarations in scope while sanitizeSVG
+// walks raw tokens, which leave prefixes unresolved.
+type svgNamespaces struct {
+	prefixes []string
+	uris     []string
+	depths   []int
+}
+
+// declare records the xmlns attributes of an element at the given depth.
+func (n *svgNamespaces) declare(attrs []xml.Attr, depth int) {
+	for _, attr := range attrs {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			n.prefixes = append(n.prefixes, "")
+		case attr.Name.Space == "xmlns":
+			n.prefixes = append(n.prefixes, attr.Name.Local)
+		default:
+			continue
+		}
+		n.uris = append(n.uris, attr.Value)
+		n.depths = append(n.depths, depth)
+	}
+}
+
+// close forgets the declarations made below depth.
+func (n *svgNamespaces) close(depth int) {
+	for len(n.depths) > 0 && n.depths[len(n.depths)-1] > depth {
+		n.prefixes = n.prefixes[:len(n.prefixes)-1]
+		n.uris = n.uris[:len(n.uris)-1]
+		n.depths = n.depths[:len(n.depths)-1]
+	}
+}
+
+// resolve returns the namespace of prefix. Unprefixed names default to SVG
+// when no default namespace is declared, and undeclared prefixes resolve to
+// no namespace.
+func (n *svgNamespaces) resolve(prefix string) string {
+	if prefix == "xml" {
+		return xmlNamespace
+	}
+	for i := len(n.prefixes) - 1; i >= 0; i-- {
+		if n.prefixes[i] == prefix {
+			return n.uris[i]
+		}
+	}
+	if prefix == "" {
+		return svgNamespace
+	}
+	return ""
+}
+
+// sanitizeSVG re-serializes an SVG document keeping only inert content.
+// Only allowlisted elements and attributes in the SVG namespace are kept, so
+// scripts, foreignObject, event handlers and anything in another namespace
+// are removed. URL attributes and CSS may only reference fragments of the
+// document or inline raster images. Comments, processing instructions and
+// doctypes are dropped. Documents that are not well-formed SVG, or whose
+// stylesheets pull in external resources, are rejected.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var buf, style bytes.Buffer
+	var open []xml.Name
+	var namespaces svgNamespaces
+	skip := 0
+	closed := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsafeSVG, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skip == 0 {
+				namespaces.declare(t.Attr, len(open)+1)
+			}
+
+			if len(open) == 0 && (closed || t.Name.Local != "svg" || namespaces.resolve(t.Name.Space) != svgNamespace) {
+				return nil, fmt.Errorf("%w: unexpected root element <%s>", ErrUnsafeSVG, t.Name.Local)
+			}
+
+			if skip == 0 && len(open) > 0 && isStyleElement(open[len(open)-1]) {
+				return nil, fmt.Errorf("%w: unexpected <%s> in stylesheet", ErrUnsafeSVG, t.Name.Local)
+			}
+
+			open = append(open, t.Name)
+			if skip > 0 || !safeSVGElement(t, &namespaces) {
+				skip++
+				continue
+			}
 
-		if isIconLink(tag) {
-			if href := extractHrefAttribute(tag); href != "" {
-				icons = append(icons, normalizeIconURL(baseURL, href))
+			buf.WriteByte('<')
+			writeXMLName(&buf, t.Name)
+			for _, attr := range t.Attr {
+				if !safeSVGAttr(attr, &namespaces) {
+					continue
+				}
+				buf.WriteByte(' ')
+				writeXMLName(&buf, attr.Name)
+				buf.WriteString(`="`)
+				xml.EscapeText(&buf, []byte(attr.Value))
+				buf.WriteByte('"')
+			}
+			buf.WriteByte('>')
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, fmt.Errorf("%w: unexpected </%s>", ErrUnsafeSVG, t.Name.Local)
+			}
+
+			open = open[:len(open)-1]
+			namespaces.close(len(open))
+			closed = len(open) == 0
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			if isStyleElement(t.Name) {
+				// Checked as a whole, since comments and CDATA sections can
+				// split a forbidden token across several chunks.
+				if !safeSVGStyle(style.String()) {
+					return nil, fmt.Errorf("%w: stylesheet references external resources", ErrUnsafeSVG)
+				}
+				xml.EscapeText(&buf, style.Bytes())
+				style.Reset()
+			}
+
+			buf.WriteString("</")
+			writeXMLName(&buf, t.Name)
+			buf.WriteByte('>')
+		case xml.CharData:
+			if len(open) == 0 || skip > 0 {
+				continue
+			}
+			if isStyleElement(open[len(open)-1]) {
+				style.Write(t)
+				continue
 			}
+			xml.EscapeText(&buf, t)
 		}
+	}
 
-		offset += end + 1
+	if !closed {
+		return nil, fmt.Errorf("%w: missing <svg> root element", ErrUnsafeSVG)
 	}
 
-	return icons
+	return buf.Bytes(), nil
+}
+
+// isStyleElement reports whether a kept element is an SVG <style>.
+func isStyleElement(name xml.Name) bool {
+	return name.Local == "style"
+}
+
+func writeXMLName(buf *bytes.Buffer, name xml.Name) {
+	if name.Space != "" {
+		buf.WriteString(name.Space)
+		buf.WriteByte(':')
+	}
+	buf.WriteString(name.Local)
 }
 
-func isIconLink(tag string) bool {
-	rel := extractAttribute(tag, "rel")
-	if rel == "" {
+func safeSVGElement(element xml.StartElement, namespaces *svgNamespaces) bool {
+	if namespaces.resolve(element.Name.Space) != svgNamespace || !svgElements[element.Name.Local] {
 		return false
 	}
 
-	rel = strings.ToLower(strings.TrimSpace(rel))
+	switch element.Name.Local {
+	case "set", "animate", "animateMotion", "animateTransform":
+		// Animations can rewrite links or event handlers after
+		// sanitization, so they may only target attributes we would keep.
+		for _, attr := range element.Attr {
+			if attr.Name.Space != "" || attr.Name.Local != "attributeName" {
+				continue
+			}
+			target := attr.Value
+			if _, local, ok := strings.Cut(target, ":"); ok {
+				target = local
+			}
+			if !svgAttributes[target] || svgURLAttributes[target] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
 
-	if !strings.Contains(rel, "icon") {
+func safeSVGAttr(attr xml.Attr, namespaces *svgNamespaces) bool {
+	name := attr.Name.Local
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+
+	switch {
+	case attr.Name.Space == "" && name == "xmlns":
+		return attr.Value == svgNamespace
+	case attr.Name.Space == "xmlns":
+		return attr.Value == svgNamespace || attr.Value == xlinkNamespace
+	case strings.Contains(value, "javascript:"):
 		return false
+	case svgURLAttributes[strings.ToLower(name)]:
+		if name != "href" || attr.Name.Space != "" && namespaces.resolve(attr.Name.Space) != xlinkNamespace {
+			return false
+		}
+		return strings.HasPrefix(value, "#") || isRasterDataURI(value)
+	case attr.Name.Space == "xml":
+		return name == "space" || name == "lang"
+	case attr.Name.Space != "" || !svgAttributes[name]:
+		return false
+	default:
+		return safeSVGStyle(value)
 	}
+}
+
+// safeSVGStyle reports whether CSS from a style element or attribute only
+// references fragments of the document or inline raster images. Quoted
+// strings are treated like url() arguments, since CSS accepts them as URLs
+// in several places, unless they are plain names such as font families.
+func safeSVGStyle(css string) bool {
+	css = strings.ToLower(strings.Join(strings.Fields(css), ""))
+	for _, token := range []string{"@import", "javascript:", `\`, "image(", "image-set("} {
+		if strings.Contains(css, token) {
+			return false
+		}
+	}
+
+	for rest := css; ; {
+		i := strings.IndexAny(rest, `"'`)
+		j := strings.Index(rest, "url(")
+		switch {
+		case i < 0 && j < 0:
+			return true
+		case j >= 0 && (i < 0 || j < i):
+			value, after, _ := strings.Cut(rest[j+len("url("):], ")")
+			value = strings.Trim(value, `"'`)
+			if !strings.HasPrefix(value, "#") && !isRasterDataURI(value) {
+				return false
+			}
+			rest = after
+		default:
+			quote := rest[i]
+			value, after, _ := strings.Cut(rest[i+1:], string(quote))
+			if !isCSSName(value) && !strings.HasPrefix(value, "#") && !isRasterDataURI(value) {
+				return false
+			}
+			rest = after
+		}
+	}
+}
 
-	excludedRels := []string{"preload", "modulepreload", "dns-prefetch", "preconnect", "prefetch"}
-	for _, excluded := range excludedRels {
-		if strings.Contains(rel, excluded) {
+// isCSSName reports whether a CSS string is a plain name rather than
+// something that could be resolved as a URL.
+func isCSSName(value string) bool {
+	for _, r := range value {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
 			return false
 		}
 	}
-
-	return true
+	return true
+}
+
+func isRasterDataURI(value string) bool {
+	for _, prefix := range []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rasterizeSVG renders an SVG document onto a size x size canvas, keeping
+// the aspect ratio of its viewBox by centering it like scaleImage does.
+func rasterizeSVG(data []byte, size int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SVG: %w", err)
+	}
+
+	if viewBox := icon.ViewBox; viewBox.W > 0 && viewBox.H > 0 {
+		scale := min(float64(size)/viewBox.W, float64(size)/viewBox.H)
+		x := (float64(size) - viewBox.W*scale) / 2
+		y := (float64(size) - viewBox.H*scale) / 2
+		icon.Transform = rasterx.Identity.Translate(x, y).Scale(scale, scale).Translate(-viewBox.X, -viewBox.Y)
+	} else {
+		icon.SetTarget(0, 0, float64(size), float64(size))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	scanner := rasterx.NewScannerGV(size, size, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(size, size, scanner), 1)
+
+	return img, nil
+}
+
+// scaleImage shrinks img to fit a size x size square using the configured
+// resampler. The aspect ratio is kept by centering the scaled image on a
+// transparent canvas. Images that already fit are returned unchanged.
+func scaleImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return img
+	}
+
+	width, height := size, size
+	if bounds.Dx() > bounds.Dy() {
+		height = max(1, (bounds.Dy()*size+bounds.Dx()/2)/bounds.Dx())
+	} else {
+		width = max(1, (bounds.Dx()*size+bounds.Dy()/2)/bounds.Dy())
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	offset := image.Pt((size-width)/2, (size-height)/2)
+	resampler.Scale(dst, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(width, height))}, img, bounds, draw.Src, nil)
+	return dst
+}
+
+// convertImage renders data in the given output format at size pixels.
+// Vector images are rasterized at that size, ICO containers use their closest
+// entry, and other bitmaps are decoded, scaled down and re-encoded.
+func convertImage(data []byte, contentType, format string, size int) ([]byte, error) {
+	var img image.Image
+	var err error
+
+	switch {
+	case strings.Contains(contentType, "svg"):
+		img, err = rasterizeSVG(data, size)
+	case isICOType(contentType):
+		img, err = decodeICOSize(data, size)
+	default:
+		img, err = decodeImage(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, scaleImage(img, size), format); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeImage writes img in one of the outputFormats.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, flattenImage(img), &jpeg.Options{Quality: jpegQuality})
+	case "webp":
+		return encodeWebP(w, img)
+	case "ico":
+		return encodeICO(w, img)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// faviconVariant returns the favicon for domain at size pixels in the
+// requested format, or in the format resizeImage picks when format is empty.
+// Renditions are derived from the original on first use and cached in
+// favicon_variants. The original is returned when it needs no changes or the
+// conversion fails.
+func faviconVariant(domain string, original *CachedFavicon, format string, size int) ([]byte, string) {
+	data, contentType := original.Data, original.ContentType
+	key := format
+	if key == "" {
+		key = "auto"
+	}
+
+	renderMetrics.VariantLookups.Add(1)
+	if variant, variantType, err := repo.GetVariant(domain, original.Hash, key, size); err == nil {
+		if len(variant) == 0 {
+			return data, contentType
+		}
+		return variant, variantType
+	}
+
+	renderMetrics.Renders.Add(1)
+	variant, outputType, err := resizeImage(data, contentType, size)
+	if err == nil && format != "" && outputType != outputFormats[format] {
+		outputType = outputFormats[format]
+		variant, err = convertImage(data, contentType, format, size)
+	}
+
+	if err != nil {
+		log.Printf("Error rendering %dpx %s favicon for %s: %v", size, key, domain, err)
+		variant, outputType = data, contentType
+	}
+
+	// An empty variant marks a rendition that is the original itself, so it
+	// is not decoded again on every request.
+	stored := variant
+	if bytes.Equal(variant, data) {
+		stored = []byte{}
+	}
+
+	if err := repo.SaveVariant(domain, original.Hash, key, size, stored, outputType); err != nil {
+		log.Printf("Error caching %dpx %s favicon for %s: %v", size, key, domain, err)
+	}
+
+	return variant, outputType
+}
+
+// negotiateRendition picks the format to serve. Without an explicit format,
+// the default rendition is used if the request's Accept header allows it, and
+// otherwise the client's preferred format among negotiableFormats. It returns
+// "" for the default rendition, and only needs the original's content type,
+// so it can run before anything is rendered.
+func negotiateRendition(r *http.Request, contentType, format string) string {
+	if format != "" {
+		return format
+	}
+
+	accept := r.Header.Get("Accept")
+	if acceptQuality(accept, renditionType(contentType, "")) > 0 {
+		return ""
+	}
+
+	return negotiateFormat(accept)
+}
+
+// renditionType returns the content type of the rendition of an original of
+// contentType in format, where "" is the format resizeImage picks.
+func renditionType(contentType, format string) string {
+	switch {
+	case format != "":
+		return outputFormats[format]
+	case isICOType(contentType), strings.Contains(contentType, "gif"), strings.Contains(contentType, "webp"):
+		return "image/png"
+	default:
+		return contentType
+	}
+}
+
+// resizeImage scales data down to fit size pixels and returns the encoded
+// result with its content type. ICO containers are reduced to their entry
+// closest to size, and ICO, GIF (first frame only) and WebP are re-encoded
+// as PNG. PNG and JPEG keep their original data whenever it cannot be
+// decoded or would not get any smaller.
+func resizeImage(data []byte, contentType string, size int) ([]byte, string, error) {
+	var img image.Image
+	var err error
+
+	outputType := renditionType(contentType, "")
+
+	switch {
+	case isICOType(contentType):
+		img, err = decodeICOSize(data, size)
+	case strings.Contains(contentType, "png"), strings.Contains(contentType, "jpeg"), strings.Contains(contentType, "jpg"),
+		strings.Contains(contentType, "gif"), strings.Contains(contentType, "webp"):
+		img, err = decodeImage(data)
+	default:
+		return data, contentType, nil
+	}
+
+	if err != nil {
+		return data, contentType, nil
+	}
+
+	scaled := scaleImage(img, size)
+	if scaled == img && outputType == contentType {
+		return data, contentType, nil
+	}
+
+	var buf bytes.Buffer
+	if strings.Contains(outputType, "png") {
+		err = png.Encode(&buf, scaled)
+	} else {
+		err = jpeg.Encode(&buf, flattenImage(scaled), &jpeg.Options{Quality: jpegQuality})
+	}
+
+	if err != nil || (outputType == contentType && buf.Len() >= len(data)) {
+		return data, contentType, nil
+	}
+
+	return buf.Bytes(), outputType, nil
+}
+
+func fetchFavicon(ctx context.Context, candidate FaviconCandidate) FaviconResult {
+	targetURL := candidate.URL
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return FaviconResult{Error: err, URL: targetURL}
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return FaviconResult{Error: err, URL: targetURL}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return FaviconResult{
+			Error: fmt.Errorf("HTTP %d", resp.StatusCode),
+			URL:   targetURL,
+		}
+	}
+
+	if resp.ContentLength > maxImageSize {
+		return FaviconResult{
+			Error: fmt.Errorf("%w: %d byte body", ErrImageTooLarge, resp.ContentLength),
+			URL:   targetURL,
+		}
+	}
+
+	declaredType := resp.Header.Get("Content-Type")
+
+	// Soft-404 pages served as HTML are rejected on their first bytes rather
+	// than after reading the whole page.
+	var prefix []byte
+	if canonicalImageType(declaredType) == "text/html" {
+		prefix, err = io.ReadAll(io.LimitReader(resp.Body, sniffPrefixSize))
+		if err != nil {
+			return FaviconResult{Error: err, URL: targetURL}
+		}
+		if sniffImageType(prefix) == "" {
+			return FaviconResult{
+				Error: fmt.Errorf("invalid content type: declared %q", declaredType),
+				URL:   targetURL,
+			}
+		}
+	}
+
+	// Read one byte past the limit, so an oversized body is rejected rather
+	// than cut off and cached as a truncated image.
+	data, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(prefix), resp.Body), maxImageSize+1))
+	if err != nil {
+		return FaviconResult{Error: err, URL: targetURL}
+	}
+	if len(data) > maxImageSize {
+		return FaviconResult{
+			Error: fmt.Errorf("%w: body exceeds %d bytes", ErrImageTooLarge, maxImageSize),
+			URL:   targetURL,
+		}
+	}
+
+	// The bytes decide the type; the header is only kept for diagnostics.
+	contentType := sniffImageType(data)
+	if !isValidImageType(contentType) {
+		return FaviconResult{
+			Error: fmt.Errorf("invalid content type: declared %q, sniffed %q", declaredType, contentType),
+			URL:   targetURL,
+		}
+	}
+
+	result := FaviconResult{
+		ContentType: contentType,
+		URL:         targetURL,
+		Candidate:   candidate,
+	}
+	// A missing header declares nothing, so it is not a mismatch.
+	if declaredType != "" && contentType != canonicalImageType(declaredType) {
+		result.DeclaredType = declaredType
+	}
+
+	if contentType == "image/svg+xml" {
+		if data, err = sanitizeSVG(data); err != nil {
+			return FaviconResult{Error: err, URL: targetURL}
+		}
+	}
+
+	result.Width, result.Height, err = validateImage(data, contentType)
+	if err != nil {
+		return FaviconResult{Error: err, URL: targetURL}
+	}
+
+	// Only mislabeled images count as mismatches, not pages that were never
+	// an image in the first place.
+	if result.DeclaredType != "" {
+		discoveryMetrics.TypeMismatches.Add(1)
+		log.Printf("Content type mismatch for %s: declared %q, sniffed %q", targetURL, declaredType, contentType)
+	}
+
+	result.Score = scoreFavicon(result)
+	result.Data = data
+
+	return result
+}
+
+// scoreFavicon ranks a fetched candidate so discovery is deterministic rather
+// than first-response-wins. Larger icons score higher (capped, since they are
+// scaled down anyway), then the image format, then the source group order.
+func scoreFavicon(result FaviconResult) int {
+	size := max(result.Width, result.Height)
+	if size == 0 {
+		size = parseIconSizes(result.Candidate.Sizes)
+	}
+	if size == 0 && strings.Contains(result.ContentType, "svg") {
+		size = scalableIconSize
+	}
+
+	score := min(size, scalableIconSize)
+	score += formatScore(result.ContentType)
+	score += max(0, 25-5*result.Candidate.Priority)
+
+	// Safari pinned-tab masks are monochrome silhouettes and only a last
+	// resort; media-specific icons (usually dark mode variants) only suit
+	// some backgrounds.
+	if slices.Contains(result.Candidate.Rel, "mask-icon") {
+		score -= 1000
+	}
+	if result.Candidate.Media != "" {
+		score -= 10
+	}
+
+	// Manifest icons meant for masking or monochrome rendering need padding
+	// or a tint applied by the platform, so plain "any" icons are preferred.
+	purpose := strings.Fields(strings.ToLower(result.Candidate.Purpose))
+	if len(purpose) > 0 && !slices.Contains(purpose, "any") {
+		switch {
+		case slices.Contains(purpose, "monochrome"):
+			score -= 1000
+		case slices.Contains(purpose, "maskable"):
+			score -= 20
+		}
+	}
+
+	return score
+}
+
+// parseIconSizes returns the largest dimension declared in a sizes attribute
+// such as "16x16 32x32" or "any".
+func parseIconSizes(sizes string) int {
+	largest := 0
+	for _, size := range strings.Fields(strings.ToLower(sizes)) {
+		if size == "any" {
+			return scalableIconSize
+		}
+
+		width, height, ok := strings.Cut(size, "x")
+		if !ok {
+			continue
+		}
+
+		w, errW := strconv.Atoi(width)
+		h, errH := strconv.Atoi(height)
+		if errW != nil || errH != nil {
+			continue
+		}
+
+		largest = max(largest, w, h)
+	}
+
+	return largest
+}
+
+func formatScore(contentType string) int {
+	if isICOType(contentType) {
+		return 30
+	}
+
+	contentType = strings.ToLower(strings.Split(contentType, ";")[0])
+
+	switch contentType {
+	case "image/png":
+		return 40
+	case "image/svg+xml":
+		return 35
+	case "image/webp":
+		return 20
+	case "image/gif":
+		return 10
+	default:
+		return 0
+	}
+}
+
+func betterFavicon(a, b *FaviconResult) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.Candidate.Priority != b.Candidate.Priority {
+		return a.Candidate.Priority < b.Candidate.Priority
+	}
+	return a.URL < b.URL
+}
+
+// fetchFaviconsParallel fetches every candidate concurrently and returns the
+// best-scoring result. Once the first icon arrives it keeps collecting for
+// faviconRankingWindow so a slower but better candidate can still win. When
+// no candidate succeeds, the error wraps ErrNoFavicon with the last failure.
+func fetchFaviconsParallel(ctx context.Context, candidateGroups [][]FaviconCandidate, timeout time.Duration) (*FaviconResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resultChan := make(chan FaviconResult, 10)
+	var wg sync.WaitGroup
+
+	seen := make(map[string]bool)
+	for _, candidates := range candidateGroups {
+		for _, candidate := range candidates {
+			if seen[candidate.URL] {
+				continue
+			}
+			seen[candidate.URL] = true
+
+			wg.Add(1)
+			go func(candidate FaviconCandidate) {
+				defer wg.Done()
+				select {
+				case resultChan <- fetchFavicon(ctx, candidate):
+				case <-ctx.Done():
+				}
+			}(candidate)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	var best *FaviconResult
+	var lastErr error
+	var window <-chan time.Time
+
+	for {
+		select {
+		case result, ok := <-resultChan:
+			if !ok {
+				if best != nil {
+					return best, nil
+				}
+				return nil, noFaviconError(lastErr)
+			}
+			if result.Error != nil {
+				lastErr = result.Error
+				continue
+			}
+			if best == nil || betterFavicon(&result, best) {
+				best = &result
+			}
+			if window == nil {
+				window = time.After(faviconRankingWindow)
+			}
+		case <-window:
+			return best, nil
+		case <-ctx.Done():
+			if best != nil {
+				return best, nil
+			}
+			return nil, noFaviconError(ctx.Err())
+		}
+	}
 }
 
-func extractHrefAttribute(tag string) string {
-	return extractAttribute(tag, "href")
+// noFaviconError wraps ErrNoFavicon with the reason discovery failed, so
+// failed lookups can tell DNS errors, timeouts and blocked hosts apart.
+func noFaviconError(reason error) error {
+	if reason == nil {
+		return ErrNoFavicon
+	}
+	return fmt.Errorf("%w: %v", ErrNoFavicon, reason)
 }
 
-func extractAttribute(tag, attrName string) string {
-	attrPrefix := attrName + "="
-	idx := strings.Index(tag, attrPrefix)
-	if idx == -1 {
+// sniffImageType identifies an image from its leading bytes, returning ""
+// for anything that is not a recognized image.
+func sniffImageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("\x00\x00\x01\x00")), bytes.HasPrefix(data, []byte("\x00\x00\x02\x00")):
+		return "image/x-icon"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "image/bmp"
+	case isSVGDocument(data):
+		return "image/svg+xml"
+	default:
 		return ""
 	}
+}
 
-	start := idx + len(attrPrefix)
-	if start >= len(tag) {
-		return ""
-	}
+// isSVGDocument reports whether the first element of data, after any XML
+// declaration, comments and doctype, is <svg>.
+func isSVGDocument(data []byte) bool {
+	rest := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
 
-	quote := tag[start]
-	if quote != '"' && quote != '\'' {
-		return ""
-	}
+	for {
+		rest = bytes.TrimLeft(rest, " \t\r\n")
+
+		var end []byte
+		switch {
+		case bytes.HasPrefix(rest, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(rest, []byte("<!")):
+			end = []byte(">")
+		default:
+			if len(rest) < 5 || !bytes.EqualFold(rest[:4], []byte("<svg")) {
+				return false
+			}
+			return bytes.ContainsAny(rest[4:5], " \t\r\n>/:")
+		}
 
-	start++
-	end := strings.IndexByte(tag[start:], quote)
-	if end == -1 {
-		return ""
+		i := bytes.Index(rest, end)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(end):]
 	}
-
-	return tag[start : start+end]
 }
 
-func resizeImage(data []byte, contentType string) ([]byte, error) {
-	var img image.Image
-	var err error
+// canonicalImageType strips parameters from a Content-Type and maps aliases
+// to the names sniffImageType uses.
+func canonicalImageType(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
 
 	switch {
-	case strings.Contains(contentType, "png"):
-		img, err = png.Decode(bytes.NewReader(data))
-	case strings.Contains(contentType, "jpeg"), strings.Contains(contentType, "jpg"):
-		img, err = jpeg.Decode(bytes.NewReader(data))
+	case isICOType(contentType):
+		return "image/x-icon"
+	case contentType == "image/jpg":
+		return "image/jpeg"
 	default:
-		return data, nil
-	}
-
-	if err != nil {
-		return data, nil
-	}
-
-	bounds := img.Bounds()
-	if bounds.Dx() <= targetIconSize && bounds.Dy() <= targetIconSize {
-		return data, nil
-	}
-
-	dst := image.NewRGBA(image.Rect(0, 0, targetIconSize, targetIconSize))
-	draw.NearestNeighbor.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
-
-	var buf bytes.Buffer
-	if strings.Contains(contentType, "png") {
-		err = png.Encode(&buf, dst)
-	} else {
-		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+		return contentType
 	}
-
-	if err != nil || buf.Len() >= len(data) {
-		return data, nil
-	}
-
-	return buf.Bytes(), nil
 }
 
-func fetchFavicon(ctx context.Context, targetURL string) FaviconResult {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
-	if err != nil {
-		return FaviconResult{Error: err, URL: targetURL}
-	}
-
-	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("Accept", "image/*")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return FaviconResult{Error: err, URL: targetURL}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return FaviconResult{
-			Error: fmt.Errorf("HTTP %d", resp.StatusCode),
-			URL:   targetURL,
-		}
-	}
-
-	contentType := resp.Header.Get("Content-Type")
-	if !isValidImageType(contentType) {
-		return FaviconResult{
-			Error: fmt.Errorf("invalid content type: %s", contentType),
-			URL:   targetURL,
+// validateImage checks that data fully decodes as contentType and returns
+// its dimensions. SVG has no intrinsic size, so its dimensions are zero.
+func validateImage(data []byte, contentType string) (int, int, error) {
+	if contentType == "image/svg+xml" {
+		if _, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode); err != nil {
+			return 0, 0, fmt.Errorf("invalid SVG: %w", err)
 		}
+		return 0, 0, nil
 	}
 
-	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize))
+	img, err := decodeImage(data)
 	if err != nil {
-		return FaviconResult{Error: err, URL: targetURL}
+		return 0, 0, fmt.Errorf("failed to decode %s: %w", contentType, err)
 	}
 
-	optimizedData, _ := resizeImage(data, contentType)
-
-	return FaviconResult{
-		Data:        optimizedData,
-		ContentType: inferContentType(targetURL, contentType),
-		URL:         targetURL,
-	}
+	bounds := img.Bounds()
+	return bounds.Dx(), bounds.Dy(), nil
 }
 
-func fetchFaviconsParallel(urlGroups [][]string, timeout time.Duration) *FaviconResult {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	resultChan := make(chan FaviconResult, 10)
-	var wg sync.WaitGroup
+// decodeImageConfig reads the dimensions data declares without decoding its
+// pixels, and rejects images that would need more than maxImagePixels, so a
+// small file cannot make the decoder allocate gigabytes.
+func decodeImageConfig(data []byte) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return config, format, fmt.Errorf("failed to read image header: %w", err)
+	}
 
-	for _, urls := range urlGroups {
-		for _, u := range urls {
-			wg.Add(1)
-			go func(targetURL string) {
-				defer wg.Done()
-				result := fetchFavicon(ctx, targetURL)
-				if result.Error == nil {
-					select {
-					case resultChan <- result:
-					case <-ctx.Done():
-					}
-				}
-			}(u)
-		}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return config, format, fmt.Errorf("%w: %dx%d pixels", ErrImageTooLarge, config.Width, config.Height)
 	}
 
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
+	return config, format, nil
+}
 
-	for result := range resultChan {
-		if result.Error == nil {
-			cancel()
-			return &result
-		}
+// decodeImage decodes data once its declared dimensions fit the pixel budget.
+// GIF animations decode to their first frame.
+func decodeImage(data []byte) (image.Image, error) {
+	if _, _, err := decodeImageConfig(data); err != nil {
+		return nil, err
 	}
 
-	return nil
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
 }
 
 func isValidImageType(contentType string) bool {
@@ -597,24 +2594,69 @@ func isValidImageType(contentType string) bool {
 	}
 }
 
-func wantsJSON(r *http.Request) bool {
-	if r.URL.Query().Get("format") == "json" {
-		return true
+// acceptQuality returns the q-value the Accept header assigns to
+// contentType, using the most specific matching media range. A missing
+// header accepts everything.
+func acceptQuality(accept, contentType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	majorType, _, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		matched := -1
+		switch mediaRange {
+		case mediaType:
+			matched = 2
+		case majorType + "/*":
+			matched = 1
+		case "*/*":
+			matched = 0
+		}
+		if matched <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		quality, specificity = q, matched
 	}
-	accept := r.Header.Get("Accept")
-	return strings.Contains(accept, "application/json")
+
+	return quality
 }
 
-func inferContentType(targetURL, respContentType string) string {
-	if respContentType != "" {
-		return respContentType
+// negotiateFormat returns the output format the Accept header prefers, or
+// "" if it accepts none of them.
+func negotiateFormat(accept string) string {
+	best, bestQuality := "", 0.0
+	for _, format := range negotiableFormats {
+		if q := acceptQuality(accept, outputFormats[format]); q > bestQuality {
+			best, bestQuality = format, q
+		}
 	}
+	return best
+}
 
-	if strings.HasSuffix(targetURL, ".png") {
-		return "image/png"
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
 	}
-
-	return "image/x-icon"
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json")
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -705,62 +2747,343 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
-		rawURL = "https://" + rawURL
+	domain, err := extractDomain(rawURL)
+	if err != nil {
+		http.Error(w, "Invalid url parameter", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if _, ok := outputFormats[format]; format != "" && !ok {
+		http.Error(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	size := targetIconSize
+	if rawSize := r.URL.Query().Get("size"); rawSize != "" {
+		size, err = strconv.Atoi(rawSize)
+		if err != nil || !slices.Contains(iconSizes, size) {
+			http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fallback := r.URL.Query().Get("fallback")
+	if fallback == "" {
+		fallback = defaultFallback
+	}
+	if !isValidFallback(fallback) {
+		http.Error(w, "Invalid fallback parameter", http.StatusBadRequest)
+		return
 	}
 
-	domain := extractDomain(rawURL)
+	w.Header().Add("Vary", "Accept")
 
-	if serveFromCache(w, r, domain) {
+	if serveFromCache(w, r, domain, format, size) {
 		return
 	}
 
-	baseURL := "https://" + domain
-	faviconURLGroups := getFaviconURLs(baseURL, domain)
+	if failure, err := repo.GetFailure(domain); err == nil {
+		serveFallback(w, r, domain, fallback, format, size, failure.RetryAfter)
+		return
+	}
 
-	result := fetchFaviconsParallel(faviconURLGroups, faviconFetchTimeout)
+	result := discoverAndCache(r.Context(), domain)
+	if result == nil && r.Context().Err() != nil {
+		return
+	}
 	if result != nil {
-		if err := repo.Save(domain, result.Data, result.ContentType); err != nil {
+		format = negotiateRendition(r, result.ContentType, format)
+		original := &CachedFavicon{Data: result.Data, ContentType: result.ContentType, Hash: contentHash(result.Data)}
+		etag := renditionETag(original.Hash, format, size)
+		data, contentType := faviconVariant(domain, original, format, size)
+		w.Header().Set("X-Favicon-Score", strconv.Itoa(result.Score))
+		serveFaviconData(w, r, data, contentType, etag, result.FetchedAt, false)
+		return
+	}
+
+	serveFallback(w, r, domain, fallback, format, size, time.Now().Add(failureTTL))
+}
+
+// discoverFavicon tries each base URL for domain in turn, so a bare domain
+// falls back to plain HTTP when nothing is found over HTTPS.
+func discoverFavicon(ctx context.Context, domain string) (*FaviconResult, error) {
+	err := ErrNoFavicon
+	for _, baseURL := range discoveryBaseURLs(domain) {
+		var result *FaviconResult
+		if result, err = discoverFaviconAt(ctx, baseURL); result != nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+func discoverFaviconAt(ctx context.Context, baseURL string) (*FaviconResult, error) {
+	_, host := urlOrigin(baseURL)
+	page := getHTMLLinks(ctx, baseURL)
+	faviconURLGroups := buildFaviconCandidates(ctx, baseURL, host, page)
+
+	result, err := fetchFaviconsParallel(ctx, faviconURLGroups, faviconFetchTimeout)
+	if result == nil {
+		return nil, err
+	}
+
+	result.Origin = baseURL
+	if origin, _ := urlOrigin(page.URL); origin != "" {
+		result.Origin = origin
+	}
+
+	return result, nil
+}
+
+// discoverAndCache runs discovery for domain and saves the result, or records
+// the failure in the negative cache. Concurrent callers for the same domain
+// share a single discovery and its result; it keeps running while any of them
+// is still waiting, and a discovery cancelled because all of them left is not
+// recorded as a failure.
+func discoverAndCache(ctx context.Context, domain string) *FaviconResult {
+	return coalesce(ctx, domain, func(ctx context.Context) *FaviconResult {
+		result, err := discoverFavicon(ctx, domain)
+		if result == nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := repo.SaveFailure(domain, err.Error()); err != nil {
+				log.Printf("Failed to record failed lookup for %s: %v", domain, err)
+			}
+			return nil
+		}
+
+		entry := &CachedFavicon{Data: result.Data, ContentType: result.ContentType, DeclaredType: result.DeclaredType, Origin: result.Origin, Score: &result.Score}
+		if err := repo.SaveEntry(domain, entry); err != nil {
 			log.Printf("Failed to cache favicon for %s: %v", domain, err)
 		}
+		result.FetchedAt = entry.FetchedAt
+		if err := repo.ClearFailure(domain); err != nil {
+			log.Printf("Failed to clear failed lookup for %s: %v", domain, err)
+		}
+		return result
+	})
+}
+
+// coalesce runs fn once for all concurrent callers with the same key. fn gets
+// a context detached from any single caller, cancelled only once every
+// caller's ctx is done, so one client disconnecting does not fail the others.
+func coalesce(ctx context.Context, key string, fn func(context.Context) *FaviconResult) *FaviconResult {
+	waiters := joinDiscovery(key)
+	defer leaveDiscovery(key, waiters)
+
+	executed := false
+	ch := discoveries.DoChan(key, func() (any, error) {
+		executed = true
+		discoveryMetrics.Started.Add(1)
+		return fn(waiters.ctx), nil
+	})
+
+	select {
+	case res := <-ch:
+		if !executed {
+			discoveryMetrics.Coalesced.Add(1)
+		}
+		result, _ := res.Val.(*FaviconResult)
+		return result
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func joinDiscovery(key string) *discoveryWaiters {
+	discoveryWaitersMu.Lock()
+	defer discoveryWaitersMu.Unlock()
+
+	waiters, ok := discoveryWaiting[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(serverCtx)
+		waiters = &discoveryWaiters{ctx: ctx, cancel: cancel}
+		discoveryWaiting[key] = waiters
+	}
+	waiters.count++
+
+	return waiters
+}
 
-		serveFaviconData(w, result.Data, result.ContentType, false)
+func leaveDiscovery(key string, waiters *discoveryWaiters) {
+	discoveryWaitersMu.Lock()
+	defer discoveryWaitersMu.Unlock()
+
+	waiters.count--
+	if waiters.count == 0 {
+		// Forget the cancelled call too, so a caller arriving before it has
+		// unwound starts a new discovery instead of sharing its nil result.
+		waiters.cancel()
+		discoveries.Forget(key)
+		delete(discoveryWaiting, key)
+	}
+}
+
+// refreshInBackground re-runs discovery for a stale domain and swaps the new
+// favicon into the cache. Only one refresh per domain runs at a time. It is
+// not tied to the request that noticed the stale entry and only stops early
+// on shutdown.
+func refreshInBackground(domain string) {
+	if _, loaded := refreshesInFlight.LoadOrStore(domain, struct{}{}); loaded {
 		return
 	}
 
-	serveDefaultFavicon(w, r)
+	backgroundRefreshes.Add(1)
+	go func() {
+		defer backgroundRefreshes.Done()
+		defer refreshesInFlight.Delete(domain)
+
+		if result := discoverAndCache(serverCtx, domain); result == nil && serverCtx.Err() == nil {
+			// Back off like a failed lookup, so a dead domain with a cached
+			// favicon is not rediscovered every few minutes forever.
+			delay := staleRetryDelay
+			if failure, err := repo.GetFailure(domain); err == nil {
+				delay = failureBackoff(failureTTL, failure.Attempts)
+			}
+			log.Printf("Failed to refresh stale favicon for %s, retrying in %s", domain, delay)
+			if err := repo.Postpone(domain, delay); err != nil {
+				log.Printf("Failed to postpone favicon refresh for %s: %v", domain, err)
+			}
+		}
+	}()
 }
 
-func serveFromCache(w http.ResponseWriter, r *http.Request, domain string) bool {
-	data, contentType, err := repo.Get(domain)
+func serveFromCache(w http.ResponseWriter, r *http.Request, domain, format string, size int) bool {
+	entry, err := repo.GetEntryMeta(domain)
 	if err != nil {
 		return false
 	}
 
-	etag := fmt.Sprintf(`"fav-%s"`, domain)
+	stale := entry.IsStale(time.Now())
+	if stale {
+		refreshInBackground(domain)
+	}
+
+	format = negotiateRendition(r, entry.ContentType, format)
 
-	clientETag := r.Header.Get("If-None-Match")
-	if clientETag == etag || clientETag == "W/"+etag {
-		w.WriteHeader(http.StatusNotModified)
+	if stale {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", staleCacheTTL))
+		w.Header().Set("X-Cache", "STALE")
+	} else {
+		setMaxAge(w, entry.ExpiresAt)
+		w.Header().Set("X-Cache", "HIT")
+	}
+	w.Header().Set("X-Favicon-Source", "cached")
+	if entry.Score != nil {
+		w.Header().Set("X-Favicon-Score", strconv.Itoa(*entry.Score))
+	}
+
+	// The ETag only depends on the original's stored hash, so revalidations
+	// are answered without reading the data or rendering anything.
+	etag := renditionETag(entry.Hash, format, size)
+	if checkNotModified(w, r, etag, entry.FetchedAt) {
 		return true
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", cacheTTL))
-	w.Header().Set("ETag", etag)
-	w.Header().Set("X-Cache", "HIT")
-	w.Header().Set("X-Favicon-Source", "cached")
+	// HEAD only needs the headers, which are known without rendering.
+	if r.Method == http.MethodHead {
+		setContentType(w, renditionType(entry.ContentType, format))
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
 
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Error writing cached response: %v", err)
+	// A refresh may have replaced the favicon since the lookup above, so the
+	// ETag follows the original that is actually served.
+	if entry, err = repo.GetEntry(domain); err != nil {
+		log.Printf("Error loading cached favicon for %s: %v", domain, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return true
 	}
 
+	data, contentType := faviconVariant(domain, entry, format, size)
+	setContentType(w, contentType)
+
+	serveContent(w, r, data, renditionETag(entry.Hash, format, size), entry.FetchedAt)
 	return true
 }
 
-func serveFaviconData(w http.ResponseWriter, data []byte, contentType string, cached bool) {
+// contentHash returns a short hex digest of data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// contentETag returns a strong ETag derived from the hash of data, so it
+// changes whenever the served bytes do.
+func contentETag(data []byte) string {
+	return `"` + contentHash(data) + `"`
+}
+
+// renditionETag returns the ETag of the rendition in format at size of the
+// original with the given contentHash. Renditions are derived
+// deterministically from the original, so it is known without rendering.
+func renditionETag(hash, format string, size int) string {
+	if format == "" {
+		format = "auto"
+	}
+	return fmt.Sprintf(`"%s-%s-%d"`, hash, format, size)
+}
+
+// checkNotModified sets the ETag and Last-Modified validators and, if the
+// request's If-None-Match or If-Modified-Since already matches them, writes
+// a 304 and returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	matched := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				matched = true
+				break
+			}
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		matched = !modified.Truncate(time.Second).After(since)
+	}
+
+	if matched {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return matched
+}
+
+// serveContent writes data with the given ETag and, when known, the time it
+// was fetched as Last-Modified. Conditional and HEAD requests are answered
+// without a body.
+func serveContent(w http.ResponseWriter, r *http.Request, data []byte, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
+
+// setContentType sets the response content type and sandboxes SVG, so that
+// anything the sanitizer missed cannot run when the icon is opened directly.
+func setContentType(w http.ResponseWriter, contentType string) {
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cacheTTL))
+
+	if strings.Contains(contentType, "svg") {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline'; sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+}
+
+func serveFaviconData(w http.ResponseWriter, r *http.Request, data []byte, contentType, etag string, fetchedAt time.Time, cached bool) {
+	setContentType(w, contentType)
+	setMaxAge(w, time.Now().Add(faviconTTL))
 
 	if cached {
 		w.Header().Set("X-Cache", "HIT")
@@ -770,28 +3093,118 @@ func serveFaviconData(w http.ResponseWriter, data []byte, contentType string, ca
 		w.Header().Set("X-Favicon-Source", "fetched")
 	}
 
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Error writing favicon response: %v", err)
+	serveContent(w, r, data, etag, fetchedAt)
+}
+
+// setMaxAge lets clients cache the response until expires, but never for
+// longer than cacheTTL.
+func setMaxAge(w http.ResponseWriter, expires time.Time) {
+	maxAge := min(time.Until(expires), cacheTTL*time.Second)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", max(int(maxAge.Seconds()), 0)))
+}
+
+// serveFallback serves the response for a domain without a favicon, as
+// selected by fallback: the default favicon, a 404, a blank pixel, a letter
+// avatar or a redirect to an allowlisted URL. The response is only cached
+// until retryAfter, when the failed lookup may be retried, so clients pick up
+// the real icon once it is found.
+func serveFallback(w http.ResponseWriter, r *http.Request, domain, fallback, format string, size int, retryAfter time.Time) {
+	setMaxAge(w, retryAfter)
+
+	switch fallback {
+	case "default":
+		serveDefaultFavicon(w, r)
+	case "404":
+		w.Header().Set("X-Cache", "DEFAULT")
+		w.Header().Set("X-Favicon-Source", "404")
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+	case "blank":
+		serveBlankFavicon(w, r, format)
+	case "letter":
+		serveLetterFavicon(w, r, domain, format, size)
+	default:
+		w.Header().Set("X-Cache", "DEFAULT")
+		w.Header().Set("X-Favicon-Source", "redirect")
+		http.Redirect(w, r, fallback, http.StatusFound)
 	}
 }
 
-func serveDefaultFavicon(w http.ResponseWriter, _ *http.Request) {
-	file, err := assets.Embeddedfiles.Open("static/favicon.ico")
+// serveBlankFavicon serves a single transparent pixel, as PNG unless another
+// format is requested.
+func serveBlankFavicon(w http.ResponseWriter, r *http.Request, format string) {
+	if format == "" {
+		format = "png"
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)), format); err != nil {
+		log.Printf("Error encoding blank favicon: %v", err)
+		serveDefaultFavicon(w, r)
+		return
+	}
+
+	setContentType(w, outputFormats[format])
+	w.Header().Set("X-Cache", "DEFAULT")
+	w.Header().Set("X-Favicon-Source", "blank")
+
+	serveContent(w, r, buf.Bytes(), contentETag(buf.Bytes()), time.Time{})
+}
+
+// serveLetterFavicon serves a generated avatar showing the domain's first
+// letter. It is SVG unless a bitmap format is requested or the Accept header
+// rules SVG out.
+func serveLetterFavicon(w http.ResponseWriter, r *http.Request, domain, format string, size int) {
+	accept := r.Header.Get("Accept")
+	if format == "" && acceptQuality(accept, "image/svg+xml") == 0 {
+		if format = negotiateFormat(accept); format == "" {
+			format = "png"
+		}
+	}
+
+	letter, background := avatarLetter(domain), avatarColor(domain)
+
+	data, contentType := renderLetterSVG(letter, background, size), "image/svg+xml"
+	if format != "" {
+		img, err := renderLetterImage(letter, background, size)
+		if err != nil {
+			log.Printf("Error rendering letter favicon for %s: %v", domain, err)
+			serveDefaultFavicon(w, r)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, img, format); err != nil {
+			log.Printf("Error encoding letter favicon for %s: %v", domain, err)
+			serveDefaultFavicon(w, r)
+			return
+		}
+		data, contentType = buf.Bytes(), outputFormats[format]
+	}
+
+	setContentType(w, contentType)
+	w.Header().Set("X-Cache", "DEFAULT")
+	w.Header().Set("X-Favicon-Source", "letter")
+
+	serveContent(w, r, data, contentETag(data), time.Time{})
+}
+
+var defaultFavicon = sync.OnceValues(func() ([]byte, error) {
+	return fs.ReadFile(assets.Embeddedfiles, "static/favicon.ico")
+})
+
+func serveDefaultFavicon(w http.ResponseWriter, r *http.Request) {
+	data, err := defaultFavicon()
 	if err != nil {
 		log.Printf("Error opening default favicon: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
 	w.Header().Set("Content-Type", "image/x-icon")
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cacheTTL))
 	w.Header().Set("X-Cache", "DEFAULT")
 	w.Header().Set("X-Favicon-Source", "default")
 
-	if _, err := io.Copy(w, file); err != nil {
-		log.Printf("Error copying default favicon: %v", err)
-	}
+	serveContent(w, r, data, contentETag(data), time.Time{})
 }
 
 func handleDomains(w http.ResponseWriter, r *http.Request) {
@@ -843,6 +3256,16 @@ func handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "favicon_discoveries_total %d\n", discoveryMetrics.Started.Load())
+	fmt.Fprintf(w, "favicon_discoveries_coalesced_total %d\n", discoveryMetrics.Coalesced.Load())
+	fmt.Fprintf(w, "favicon_content_type_mismatches_total %d\n", discoveryMetrics.TypeMismatches.Load())
+	fmt.Fprintf(w, "favicon_variant_lookups_total %d\n", renderMetrics.VariantLookups.Load())
+	fmt.Fprintf(w, "favicon_renders_total %d\n", renderMetrics.Renders.Load())
+}
+
 func handleFavicon(w http.ResponseWriter, r *http.Request) {
 	file, err := assets.Embeddedfiles.Open("static/favicon.ico")
 	if err != nil {
@@ -886,12 +3309,16 @@ func main() {
 	mux.HandleFunc("GET /robots.txt", handleRobotsTxt)
 	mux.HandleFunc("GET /favicon.ico", handleFavicon)
 	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /metrics", handleMetrics)
 	mux.HandleFunc("GET /domains", handleDomains)
 	mux.HandleFunc("GET /", handleHome)
 
 	server := &http.Server{
 		Addr:    serverAddr,
 		Handler: corsMiddleware(mux),
+		BaseContext: func(net.Listener) context.Context {
+			return serverCtx
+		},
 	}
 
 	quit := make(chan os.Signal, 1)
@@ -914,5 +3341,8 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	stopServer()
+	backgroundRefreshes.Wait()
+
 	log.Println("Server stopped")
 }
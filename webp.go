@@ -0,0 +1,689 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+	"slices"
+)
+
+const (
+	// webpPredictorBits is the log2 size of the tiles that each get their own
+	// spatial predictor.
+	webpPredictorBits = 4
+
+	webpLiteralCodes = 256
+	webpLengthCodes  = 24
+	webpDistCodes    = 40
+
+	webpMaxCacheBits = 10
+	webpCacheHash    = 0x1e35a7bd
+
+	webpMinMatch   = 3
+	webpMaxMatch   = 4096
+	webpMaxDist    = 1<<20 - 120
+	webpHashBits   = 15
+	webpChainLimit = 32
+)
+
+// webpCodeLengthOrder is the order in which VP8L stores the code lengths of
+// its code length code.
+var webpCodeLengthOrder = [...]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type webpBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write appends the n low bits of value, least significant bit first.
+func (w *webpBitWriter) write(value uint32, n uint) {
+	w.acc |= uint64(value) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *webpBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// encodeWebP writes img as a lossless (VP8L) WebP. Like libwebp's fast
+// settings, it applies the subtract-green and per-tile predictor transforms,
+// finds LZ77 backward references and codes the result with Huffman codes
+// built from its histograms, trying a few color cache sizes and keeping the
+// smallest result.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return fmt.Errorf("invalid WebP dimensions %dx%d", width, height)
+	}
+
+	// Pixels are kept in RGBA byte order, one uint8 per channel.
+	pix := make([]uint8, 0, 4*width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			pix = append(pix, c.R, c.G, c.B, c.A)
+		}
+	}
+
+	// The decoder undoes transforms in reverse order, so subtract green is
+	// applied first and undone last.
+	for p := 0; p < len(pix); p += 4 {
+		pix[p] -= pix[p+1]
+		pix[p+2] -= pix[p+1]
+	}
+	modes, residuals := webpPredict(pix, width, height)
+
+	var data []byte
+	for cacheBits := uint(0); cacheBits <= webpMaxCacheBits; cacheBits += 2 {
+		var bw webpBitWriter
+		bw.write(0x2f, 8)
+		bw.write(uint32(width-1), 14)
+		bw.write(uint32(height-1), 14)
+		bw.write(1, 1) // alpha is used
+		bw.write(0, 3) // version
+
+		bw.write(1, 1)
+		bw.write(2, 2) // subtract green
+
+		bw.write(1, 1)
+		bw.write(0, 2) // predictor
+		bw.write(webpPredictorBits-2, 3)
+		webpWriteImage(&bw, modes, (width+1<<webpPredictorBits-1)>>webpPredictorBits, false, 0)
+
+		bw.write(0, 1) // no more transforms
+		webpWriteImage(&bw, residuals, width, true, cacheBits)
+
+		if encoded := bw.bytes(); data == nil || len(encoded) < len(data) {
+			data = encoded
+		}
+	}
+
+	padding := len(data) & 1
+
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+padding))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padding == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// webpPredict picks the predictor that leaves the smallest residuals for each
+// tile, and returns the tile image holding the chosen modes along with the
+// residuals. The first row and column use the fixed predictors the format
+// prescribes.
+func webpPredict(pix []uint8, width, height int) (modes, residuals []uint8) {
+	tileSize := 1 << webpPredictorBits
+	tilesX := (width + tileSize - 1) / tileSize
+	tilesY := (height + tileSize - 1) / tileSize
+
+	modes = make([]uint8, 4*tilesX*tilesY)
+	for ty := range tilesY {
+		for tx := range tilesX {
+			best, bestCost := 0, -1
+			for mode := range 14 {
+				cost := 0
+				for y := max(ty*tileSize, 1); y < min((ty+1)*tileSize, height); y++ {
+					for x := max(tx*tileSize, 1); x < min((tx+1)*tileSize, width); x++ {
+						p := 4 * (y*width + x)
+						predicted := webpPredictPixel(mode, pix, p, p-4*width)
+						for c := range 4 {
+							r := pix[p+c] - predicted[c]
+							cost += int(min(r, -r))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			q := 4 * (ty*tilesX + tx)
+			modes[q+1], modes[q+3] = uint8(best), 0xff
+		}
+	}
+
+	residuals = make([]uint8, len(pix))
+	for y := range height {
+		for x := range width {
+			p := 4 * (y*width + x)
+			var predicted [4]uint8
+			switch {
+			case x == 0 && y == 0:
+				predicted = [4]uint8{3: 0xff}
+			case y == 0:
+				predicted = [4]uint8(pix[p-4 : p])
+			case x == 0:
+				predicted = [4]uint8(pix[p-4*width : p-4*width+4])
+			default:
+				mode := modes[4*((y>>webpPredictorBits)*tilesX+x>>webpPredictorBits)+1]
+				predicted = webpPredictPixel(int(mode), pix, p, p-4*width)
+			}
+			for c := range 4 {
+				residuals[p+c] = pix[p+c] - predicted[c]
+			}
+		}
+	}
+
+	return modes, residuals
+}
+
+// webpPredictPixel returns the prediction of the given VP8L mode for the pixel
+// at offset p, whose top neighbor is at offset top. The pixel must not be in
+// the first row or column.
+func webpPredictPixel(mode int, pix []uint8, p, top int) [4]uint8 {
+	var out [4]uint8
+	if mode == 11 {
+		// Select: whichever of L and T is closer to L + T - TL.
+		var distL, distT int
+		for c := range 4 {
+			tl := int(pix[top-4+c])
+			distL += webpAbs(tl - int(pix[top+c]))
+			distT += webpAbs(tl - int(pix[p-4+c]))
+		}
+		if distL < distT {
+			return [4]uint8(pix[p-4 : p])
+		}
+		return [4]uint8(pix[top : top+4])
+	}
+
+	for c := range 4 {
+		l, t, tr, tl := pix[p-4+c], pix[top+c], pix[top+4+c], pix[top-4+c]
+
+		switch mode {
+		case 0:
+			if c == 3 {
+				out[c] = 0xff
+			}
+		case 1:
+			out[c] = l
+		case 2:
+			out[c] = t
+		case 3:
+			out[c] = tr
+		case 4:
+			out[c] = tl
+		case 5:
+			out[c] = webpAverage(webpAverage(l, tr), t)
+		case 6:
+			out[c] = webpAverage(l, tl)
+		case 7:
+			out[c] = webpAverage(l, t)
+		case 8:
+			out[c] = webpAverage(tl, t)
+		case 9:
+			out[c] = webpAverage(t, tr)
+		case 10:
+			out[c] = webpAverage(webpAverage(l, tl), webpAverage(t, tr))
+		case 12:
+			out[c] = uint8(min(max(int(l)+int(t)-int(tl), 0), 255))
+		case 13:
+			a := int(webpAverage(l, t))
+			out[c] = uint8(min(max(a+(a-int(tl))/2, 0), 255))
+		}
+	}
+	return out
+}
+
+func webpAverage(a, b uint8) uint8 {
+	return uint8((int(a) + int(b)) / 2)
+}
+
+func webpAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// webpSymbol is a literal pixel, a color cache hit for that pixel, or an LZ77
+// backward reference of length pixels at distance code dist.
+type webpSymbol struct {
+	pixel  int
+	cached int
+	length int
+	dist   int
+}
+
+// webpWriteImage writes the entropy-coded pixels of an image of the given
+// width: LZ77 backward references, color cache hits and literals, coded with
+// a single group of Huffman codes. A cacheBits of 0 disables the cache.
+func webpWriteImage(bw *webpBitWriter, pix []uint8, width int, topLevel bool, cacheBits uint) {
+	if cacheBits > 0 {
+		bw.write(1, 1)
+		bw.write(uint32(cacheBits), 4)
+	} else {
+		bw.write(0, 1)
+	}
+	if topLevel {
+		bw.write(0, 1) // a single prefix code group
+	}
+
+	symbols := webpBackwardReferences(pix, width)
+	if cacheBits > 0 {
+		webpColorCache(symbols, pix, cacheBits)
+	}
+
+	green := make([]int, webpLiteralCodes+webpLengthCodes)
+	if cacheBits > 0 {
+		green = append(green, make([]int, 1<<cacheBits)...)
+	}
+	var red, blue, alpha [webpLiteralCodes]int
+	var dist [webpDistCodes]int
+	for _, s := range symbols {
+		if s.cached > 0 {
+			green[webpLiteralCodes+webpLengthCodes+s.cached-1]++
+			continue
+		}
+		if s.length == 0 {
+			p := 4 * s.pixel
+			red[pix[p]]++
+			green[pix[p+1]]++
+			blue[pix[p+2]]++
+			alpha[pix[p+3]]++
+			continue
+		}
+		code, _, _ := webpPrefixEncode(s.length)
+		green[webpLiteralCodes+code]++
+		code, _, _ = webpPrefixEncode(s.dist)
+		dist[code]++
+	}
+
+	greenCode := webpWritePrefixCode(bw, green)
+	redCode := webpWritePrefixCode(bw, red[:])
+	blueCode := webpWritePrefixCode(bw, blue[:])
+	alphaCode := webpWritePrefixCode(bw, alpha[:])
+	distCode := webpWritePrefixCode(bw, dist[:])
+
+	for _, s := range symbols {
+		if s.cached > 0 {
+			greenCode.write(bw, webpLiteralCodes+webpLengthCodes+s.cached-1)
+			continue
+		}
+		if s.length == 0 {
+			p := 4 * s.pixel
+			greenCode.write(bw, int(pix[p+1]))
+			redCode.write(bw, int(pix[p]))
+			blueCode.write(bw, int(pix[p+2]))
+			alphaCode.write(bw, int(pix[p+3]))
+			continue
+		}
+		code, n, extra := webpPrefixEncode(s.length)
+		greenCode.write(bw, webpLiteralCodes+code)
+		bw.write(uint32(extra), n)
+		code, n, extra = webpPrefixEncode(s.dist)
+		distCode.write(bw, code)
+		bw.write(uint32(extra), n)
+	}
+}
+
+// webpColorCache replays the decoder's color cache, which holds every pixel
+// decoded so far by a hash of its ARGB value, and turns literals found in it
+// into cache hits. cached holds the cache index plus one.
+func webpColorCache(symbols []webpSymbol, pix []uint8, cacheBits uint) {
+	cache := make([]uint32, 1<<cacheBits)
+	argb := func(i int) uint32 {
+		p := 4 * i
+		return uint32(pix[p+3])<<24 | uint32(pix[p])<<16 | uint32(pix[p+1])<<8 | uint32(pix[p+2])
+	}
+	index := func(color uint32) uint32 { return color * webpCacheHash >> (32 - cacheBits) }
+
+	pos := 0
+	for i := range symbols {
+		s := &symbols[i]
+		if s.length > 0 {
+			for end := pos + s.length; pos < end; pos++ {
+				cache[index(argb(pos))] = argb(pos)
+			}
+			continue
+		}
+		color := argb(pos)
+		if cache[index(color)] == color {
+			s.cached = int(index(color)) + 1
+		}
+		cache[index(color)] = color
+		pos++
+	}
+}
+
+// webpBackwardReferences greedily replaces runs of pixels seen before with
+// LZ77 references, using hash chains over three-pixel sequences.
+func webpBackwardReferences(pix []uint8, width int) []webpSymbol {
+	n := len(pix) / 4
+	at := func(i int) uint32 { return binary.LittleEndian.Uint32(pix[4*i:]) }
+
+	// Distances that are a neighbor in the row above, or the previous pixel,
+	// have short plane codes of their own; others are offset past them.
+	planeCodes := make(map[int]int)
+	for code, offset := range [][2]int{{0, 1}, {1, 0}, {1, 1}, {-1, 1}} {
+		if d := max(offset[0]+offset[1]*width, 1); planeCodes[d] == 0 {
+			planeCodes[d] = code + 1
+		}
+	}
+	distCode := func(d int) int {
+		if code, ok := planeCodes[d]; ok {
+			return code
+		}
+		return d + 120
+	}
+
+	head := make([]int32, 1<<webpHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, n)
+	hash := func(i int) uint32 {
+		return (at(i)*0x1e35a7bd ^ at(i+1)*0x9e3779b1 ^ at(i+2)*0x85ebca6b) >> (32 - webpHashBits)
+	}
+	insert := func(i int) {
+		if i+webpMinMatch <= n {
+			h := hash(i)
+			chain[i], head[h] = head[h], int32(i)
+		}
+	}
+	matchLength := func(i, j int) int {
+		length := 0
+		for i+length < n && length < webpMaxMatch && at(i+length) == at(j+length) {
+			length++
+		}
+		return length
+	}
+
+	var symbols []webpSymbol
+	for i := 0; i < n; {
+		bestLength, bestDist := 0, 0
+		try := func(j int) {
+			if j < 0 || j >= i || i-j > webpMaxDist {
+				return
+			}
+			if length := matchLength(i, j); length > bestLength {
+				bestLength, bestDist = length, i-j
+			}
+		}
+
+		if i+webpMinMatch <= n {
+			try(i - 1)
+			try(i - width)
+			for j, tries := head[hash(i)], 0; j >= 0 && tries < webpChainLimit; j, tries = chain[j], tries+1 {
+				try(int(j))
+			}
+		}
+
+		if bestLength < webpMinMatch {
+			symbols = append(symbols, webpSymbol{pixel: i})
+			insert(i)
+			i++
+			continue
+		}
+
+		symbols = append(symbols, webpSymbol{length: bestLength, dist: distCode(bestDist)})
+		for end := i + bestLength; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	return symbols
+}
+
+// webpPrefixEncode splits an LZ77 length or distance code into its prefix
+// symbol and the extra bits that follow it.
+func webpPrefixEncode(value int) (code int, extraBits uint, extra int) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	high := bits.Len(uint(d)) - 1
+	second := (d >> (high - 1)) & 1
+	extraBits = uint(high - 1)
+	return 2*high + second, extraBits, d & (1<<extraBits - 1)
+}
+
+// webpPrefixCode is a canonical Huffman code; symbols with a zero length are
+// written with no bits at all, which is how a code of one symbol is coded.
+type webpPrefixCode struct {
+	lengths []int
+	codes   []uint32
+}
+
+func (c *webpPrefixCode) write(bw *webpBitWriter, symbol int) {
+	if n := c.lengths[symbol]; n > 0 {
+		bw.write(c.codes[symbol], uint(n))
+	}
+}
+
+// webpWritePrefixCode writes the Huffman code for the symbol counts and
+// returns it for coding the symbols.
+func webpWritePrefixCode(bw *webpBitWriter, counts []int) *webpPrefixCode {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+
+	code := &webpPrefixCode{lengths: make([]int, len(counts)), codes: make([]uint32, len(counts))}
+
+	// One or two literal symbols fit the simple code, which spells them out.
+	if len(used) <= 2 && used[len(used)-1] < webpLiteralCodes {
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	lengths := huffmanCodeLengths(counts, 15)
+	if len(used) == 1 {
+		lengths[used[0]] = 1
+	}
+	bw.write(0, 1)
+	webpWriteCodeLengths(bw, lengths)
+
+	if len(used) > 1 {
+		copy(code.lengths, lengths)
+		code.codes = canonicalCodes(lengths)
+	}
+	return code
+}
+
+// webpWriteCodeLengths writes the code lengths of a normal prefix code, run
+// length coded and themselves Huffman coded with the code length code.
+func webpWriteCodeLengths(bw *webpBitWriter, lengths []int) {
+	type token struct {
+		symbol, extra int
+		extraBits     uint
+	}
+
+	var tokens []token
+	previous := 8
+	for i := 0; i < len(lengths); {
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == lengths[i] {
+			run++
+		}
+
+		switch length := lengths[i]; {
+		case length == 0 && run >= 11:
+			run = min(run, 138)
+			tokens = append(tokens, token{18, run - 11, 7})
+		case length == 0 && run >= 3:
+			run = min(run, 10)
+			tokens = append(tokens, token{17, run - 3, 3})
+		case length != 0 && length == previous && run >= 3:
+			run = min(run, 6)
+			tokens = append(tokens, token{16, run - 3, 2})
+		default:
+			run = 1
+			tokens = append(tokens, token{symbol: length})
+			if length != 0 {
+				previous = length
+			}
+		}
+		i += run
+	}
+
+	var counts [len(webpCodeLengthOrder)]int
+	for _, t := range tokens {
+		counts[t.symbol]++
+	}
+	codeLengths := huffmanCodeLengths(counts[:], 7)
+
+	used := 0
+	for _, length := range codeLengths {
+		if length > 0 {
+			used++
+		}
+	}
+	if used == 1 {
+		for symbol, count := range counts {
+			if count > 0 {
+				codeLengths[symbol] = 1
+			}
+		}
+	}
+
+	n := 4
+	for i, symbol := range webpCodeLengthOrder {
+		if codeLengths[symbol] > 0 {
+			n = max(n, i+1)
+		}
+	}
+	bw.write(uint32(n-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:n] {
+		bw.write(uint32(codeLengths[symbol]), 3)
+	}
+	bw.write(0, 1) // code lengths for the whole alphabet follow
+
+	codes := canonicalCodes(codeLengths)
+	for _, t := range tokens {
+		if used > 1 {
+			bw.write(codes[t.symbol], uint(codeLengths[t.symbol]))
+		}
+		bw.write(uint32(t.extra), t.extraBits)
+	}
+}
+
+// huffmanCodeLengths returns Huffman code lengths for the symbol counts, no
+// longer than maxLength. Rare symbols are counted as more frequent until the
+// code fits.
+func huffmanCodeLengths(counts []int, maxLength int) []int {
+	lengths := make([]int, len(counts))
+
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) < 2 {
+		return lengths
+	}
+
+	n := len(symbols)
+	for floor := 1; ; floor *= 2 {
+		weight := func(symbol int) int { return max(counts[symbol], floor) }
+		slices.SortStableFunc(symbols, func(a, b int) int { return cmp.Compare(weight(a), weight(b)) })
+
+		// Leaves are taken in order of weight and merged nodes are created in
+		// order of weight, so the two lightest nodes are always at the front
+		// of one of the two queues.
+		weights := make([]int, 2*n-1)
+		parents := make([]int, 2*n-1)
+		for i, symbol := range symbols {
+			weights[i] = weight(symbol)
+		}
+		leaf, merged := 0, n
+		lightest := func(next int) int {
+			if leaf < n && (merged == next || weights[leaf] <= weights[merged]) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for next := n; next < 2*n-1; next++ {
+			a, b := lightest(next), lightest(next)
+			weights[next] = weights[a] + weights[b]
+			parents[a], parents[b] = next, next
+		}
+
+		depths := make([]int, 2*n-1)
+		for i := 2*n - 3; i >= 0; i-- {
+			depths[i] = depths[parents[i]] + 1
+		}
+
+		longest := 0
+		for i, symbol := range symbols {
+			lengths[symbol] = depths[i]
+			longest = max(longest, depths[i])
+		}
+		if longest <= maxLength {
+			return lengths
+		}
+	}
+}
+
+// canonicalCodes assigns canonical Huffman codes for the code lengths, bit
+// reversed so they can be written least significant bit first.
+func canonicalCodes(lengths []int) []uint32 {
+	var perLength [16]uint32
+	for _, length := range lengths {
+		if length > 0 {
+			perLength[length]++
+		}
+	}
+
+	var next [16]uint32
+	code := uint32(0)
+	for length := 1; length < len(next); length++ {
+		code = (code + perLength[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			codes[symbol] = uint32(bits.Reverse16(uint16(next[length]))) >> (16 - length)
+			next[length]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	for y := range 3 {
+		for x := range 5 {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(50 * x), G: uint8(80 * y), B: uint8(x * y), A: uint8(255 - 40*x)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, img); err != nil {
+		t.Fatalf("encodeWebP failed: %v", err)
+	}
+
+	decoded, err := webp.Decode(&buf)
+	if err != nil {
+		t.Fatalf("webp.Decode failed: %v", err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("Expected bounds %v, got %v", img.Bounds(), decoded.Bounds())
+	}
+
+	for y := range 3 {
+		for x := range 5 {
+			want := img.NRGBAAt(x, y)
+			if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != want {
+				t.Errorf("Pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPCompresses(t *testing.T) {
+	// A typical upscaled icon: a filled circle with a gradient on a
+	// transparent background.
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for y := range 256 {
+		for x := range 256 {
+			if dx, dy := x-128, y-128; dx*dx+dy*dy < 100*100 {
+				img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: 64, B: uint8(y), A: 255})
+			}
+		}
+	}
+
+	var webpBuf, pngBuf bytes.Buffer
+	if err := encodeWebP(&webpBuf, img); err != nil {
+		t.Fatalf("encodeWebP failed: %v", err)
+	}
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	if webpBuf.Len() > pngBuf.Len() {
+		t.Errorf("Expected WebP (%d bytes) to be no larger than PNG (%d bytes)", webpBuf.Len(), pngBuf.Len())
+	}
+
+	decoded, err := webp.Decode(&webpBuf)
+	if err != nil {
+		t.Fatalf("webp.Decode failed: %v", err)
+	}
+	for y := range 256 {
+		for x := range 256 {
+			want := img.NRGBAAt(x, y)
+			if got := color.NRGBAModel.Convert(decoded.At(x, y)); got != want {
+				t.Fatalf("Pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}